@@ -0,0 +1,178 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// AccessPolicy determines which repositories may be accessed through
+// vcsserver.
+type AccessPolicy struct {
+	// Hosts is the list of rules for hosts whose repositories may be accessed.
+	// The first rule whose Host matches the requested host applies; if no rule
+	// matches, access is denied.
+	Hosts []*HostRule
+}
+
+// HostRule describes which repositories on a host (or set of hosts) may be
+// accessed.
+type HostRule struct {
+	// Host is the host name, or a pattern of the form "*.example.com" that
+	// matches all subdomains (but not example.com itself), optionally
+	// followed by a port (e.g., "git.example.com:8443"). IPv6 addresses must be
+	// bracketed (e.g., "[::1]"). A rule without a port only matches hosts
+	// without a port.
+	Host string
+
+	// VCS is the list of VCS types (e.g., "git", "hg") that may be used with
+	// the host. If empty, all VCS types are allowed.
+	VCS []string
+
+	// Schemes is the list of URL schemes (e.g., "https", "git") that may be
+	// used to clone from the host. If empty, all schemes are allowed.
+	Schemes []string
+
+	// Allow is the list of repository path patterns that may be accessed. If
+	// empty, all repository paths are allowed. Patterns use the syntax of
+	// path.Match and match a repository if they match its path or any of its
+	// parent directories (e.g., "ourorg/*" and "ourorg" both match
+	// "ourorg/repo").
+	Allow []string
+
+	// Deny is the list of repository path patterns that may not be accessed,
+	// in the same syntax as Allow. Deny takes precedence over Allow.
+	Deny []string
+
+	// CaseInsensitivePaths is whether repository paths on the host are case
+	// insensitive, i.e., whether paths that differ only in case refer to the
+	// same repository (and mirror). Paths on github.com, gitlab.com and
+	// bitbucket.org are always case insensitive.
+	CaseInsensitivePaths bool
+
+	// SSH describes how to clone repositories from the host over SSH (i.e.,
+	// for the "ssh" scheme). If nil, the "git" user and ssh's default keys
+	// and known_hosts files are used.
+	SSH *SSHConfig
+}
+
+// HostsPolicy returns an AccessPolicy that allows access to all repositories
+// on the specified hosts (and only those hosts).
+func HostsPolicy(hosts []string) *AccessPolicy {
+	p := &AccessPolicy{Hosts: make([]*HostRule, len(hosts))}
+	for i, host := range hosts {
+		p.Hosts[i] = &HostRule{Host: host}
+	}
+	return p
+}
+
+// LoadAccessPolicy reads a JSON-encoded AccessPolicy from the named file.
+func LoadAccessPolicy(filename string) (*AccessPolicy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p AccessPolicy
+	err = json.NewDecoder(f).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// check returns the rule for host, or a non-nil *httpError if access to the
+// repository at repoPath (a clean path with no leading slash) on host, using the
+// specified VCS type and scheme, is not allowed. Allow and Deny patterns are
+// matched against the canonical forms of the path and the patterns.
+func (p *AccessPolicy) check(vcsName, scheme, host, repoPath string) (*HostRule, *httpError) {
+	rule := p.rule(host)
+	if rule == nil {
+		return nil, &httpError{"access to specified host is not allowed", http.StatusForbidden}
+	}
+	if len(rule.VCS) > 0 && !contains(rule.VCS, vcsName) {
+		return nil, &httpError{"access to specified VCS type is not allowed on host", http.StatusForbidden}
+	}
+	if len(rule.Schemes) > 0 && !contains(rule.Schemes, scheme) {
+		return nil, &httpError{"access to specified scheme is not allowed on host", http.StatusForbidden}
+	}
+	caseInsensitive := rule.caseInsensitive(host)
+	repoPath = canonicalRepoPath(repoPath, caseInsensitive)
+	if matchAnyPathPrefix(rule.Deny, repoPath, caseInsensitive) || (len(rule.Allow) > 0 && !matchAnyPathPrefix(rule.Allow, repoPath, caseInsensitive)) {
+		return nil, &httpError{"access to specified repository is not allowed", http.StatusForbidden}
+	}
+	return rule, nil
+}
+
+// rule returns the first rule that matches host, or nil if there is none.
+func (p *AccessPolicy) rule(host string) *HostRule {
+	for _, rule := range p.Hosts {
+		if matchHost(rule.Host, host) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchHost returns true if host matches pattern, which is either a host name
+// or a pattern of the form "*.example.com", and their ports (if any) are equal.
+func matchHost(pattern, host string) bool {
+	pattern, patternPort := splitHostPort(strings.ToLower(pattern))
+	host, port := splitHostPort(strings.ToLower(host))
+	if patternPort != port {
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return pattern == host
+}
+
+// splitHostPort splits hostport (e.g., "example.com:8443" or "[::1]:8443")
+// into its host (with IPv6 brackets removed) and port, which is empty if
+// hostport has no port.
+func splitHostPort(hostport string) (host, port string) {
+	host = hostport
+	if strings.HasPrefix(hostport, "[") {
+		if i := strings.LastIndex(hostport, "]"); i != -1 {
+			host, port = hostport[1:i], strings.TrimPrefix(hostport[i+1:], ":")
+		}
+	} else if i := strings.LastIndex(hostport, ":"); i != -1 {
+		host, port = hostport[:i], hostport[i+1:]
+	}
+	return host, port
+}
+
+// caseInsensitive returns true if repository paths on host, which matches the
+// rule, are case insensitive.
+func (rule *HostRule) caseInsensitive(host string) bool {
+	host, _ = splitHostPort(strings.ToLower(host))
+	return rule.CaseInsensitivePaths || caseInsensitiveHosts[host]
+}
+
+// matchAnyPathPrefix returns true if the canonical form of any of patterns
+// matches p (a canonical repository path) or one of its parent directories.
+func matchAnyPathPrefix(patterns []string, p string, caseInsensitive bool) bool {
+	components := strings.Split(p, "/")
+	for _, pattern := range patterns {
+		pattern = canonicalRepoPath(pattern, caseInsensitive)
+		for i := range components {
+			if ok, _ := path.Match(pattern, strings.Join(components[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	policy := &AccessPolicy{Hosts: []*HostRule{
+		{Host: "secret.example.com", Deny: []string{"*"}},
+		{Host: "*.example.com", VCS: []string{"git"}},
+		{Host: "git.internal:8443"},
+		{Host: "[::1]"},
+		{Host: "sensitive.internal", Deny: []string{"Secret.git"}},
+		{Host: "insensitive.internal", CaseInsensitivePaths: true, Deny: []string{"Secret.git"}},
+		{Host: "github.com", Schemes: []string{"https"}, Allow: []string{"ourorg/*"}, Deny: []string{"ourorg/private*"}},
+	}}
+
+	forbidden := func(message string) *httpError { return &httpError{message, http.StatusForbidden} }
+	tests := []struct {
+		vcs, scheme, host, repoPath string
+		wantErr                     *httpError
+	}{
+		{vcs: "git", scheme: "https", host: "git.example.com", repoPath: "a/b"},
+		{vcs: "git", scheme: "https", host: "a.git.example.com", repoPath: "a/b"},
+		{vcs: "git", scheme: "https", host: "GIT.Example.com", repoPath: "a/b"},
+		{vcs: "hg", scheme: "https", host: "git.example.com", repoPath: "a/b", wantErr: forbidden("access to specified VCS type is not allowed on host")},
+		{vcs: "git", scheme: "https", host: "example.com", repoPath: "a/b", wantErr: forbidden("access to specified host is not allowed")},
+		{vcs: "git", scheme: "https", host: "secret.example.com", repoPath: "a/b", wantErr: forbidden("access to specified repository is not allowed")},
+		{vcs: "git", scheme: "https", host: "github.com", repoPath: "ourorg/repo.git"},
+		{vcs: "git", scheme: "https", host: "git.internal:8443", repoPath: "a/b"},
+		{vcs: "git", scheme: "https", host: "git.internal", repoPath: "a/b", wantErr: forbidden("access to specified host is not allowed")},
+		{vcs: "git", scheme: "https", host: "git.internal:443", repoPath: "a/b", wantErr: forbidden("access to specified host is not allowed")},
+		{vcs: "git", scheme: "https", host: "[::1]", repoPath: "a/b"},
+		{vcs: "git", scheme: "https", host: "[::1]:8080", repoPath: "a/b", wantErr: forbidden("access to specified host is not allowed")},
+		{vcs: "git", scheme: "https", host: "github.com", repoPath: "ourorg/sub/repo.git"},
+		{vcs: "git", scheme: "git", host: "github.com", repoPath: "ourorg/repo.git", wantErr: forbidden("access to specified scheme is not allowed on host")},
+		{vcs: "git", scheme: "https", host: "github.com", repoPath: "otherorg/repo.git", wantErr: forbidden("access to specified repository is not allowed")},
+		{vcs: "git", scheme: "https", host: "github.com", repoPath: "ourorg/private-repo.git", wantErr: forbidden("access to specified repository is not allowed")},
+		{vcs: "git", scheme: "https", host: "github.com", repoPath: "OurOrg/Private-Repo", wantErr: forbidden("access to specified repository is not allowed")},
+		{vcs: "git", scheme: "https", host: "sensitive.internal", repoPath: "Secret.git", wantErr: forbidden("access to specified repository is not allowed")},
+		{vcs: "git", scheme: "https", host: "sensitive.internal", repoPath: "secret.git"},
+		{vcs: "git", scheme: "https", host: "insensitive.internal", repoPath: "secret.git", wantErr: forbidden("access to specified repository is not allowed")},
+	}
+
+	for _, test := range tests {
+		_, err := policy.check(test.vcs, test.scheme, test.host, test.repoPath)
+		if !reflect.DeepEqual(test.wantErr, err) {
+			t.Errorf("%s %s://%s/%s: want err %v, got %v", test.vcs, test.scheme, test.host, test.repoPath, test.wantErr, err)
+		}
+	}
+}
+
+func TestLoadAccessPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "vcsserver-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"Hosts": [{"Host": "*.example.com", "VCS": ["git"], "Allow": ["ourorg/*"]}]}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadAccessPolicy(f.Name())
+	if err != nil {
+		t.Fatal("LoadAccessPolicy:", err)
+	}
+	want := &AccessPolicy{Hosts: []*HostRule{{Host: "*.example.com", VCS: []string{"git"}, Allow: []string{"ourorg/*"}}}}
+	if !reflect.DeepEqual(want, policy) {
+		t.Errorf("want policy %+v, got %+v", want, policy)
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		hostport, wantHost, wantPort string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com:8443", "example.com", "8443"},
+		{"[::1]", "::1", ""},
+		{"[::1]:8443", "::1", "8443"},
+		{"[2001:db8::1]:22", "2001:db8::1", "22"},
+	}
+
+	for _, test := range tests {
+		host, port := splitHostPort(test.hostport)
+		if host != test.wantHost || port != test.wantPort {
+			t.Errorf("%s: want (%q, %q), got (%q, %q)", test.hostport, test.wantHost, test.wantPort, host, port)
+		}
+	}
+}
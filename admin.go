@@ -0,0 +1,440 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"github.com/sourcegraph/go-vcs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// adminPathPrefix is the prefix of the paths of the admin API.
+	adminPathPrefix = "/admin/"
+
+	// adminReposPath is the path at which stored mirrors are listed. Each
+	// mirror is at adminReposPath + "/" + its ID.
+	adminReposPath = "/admin/repos"
+)
+
+// MirrorInfo describes a stored mirror.
+type MirrorInfo struct {
+	// ID identifies the mirror in admin API paths. It is the path of the
+	// mirror's directory relative to the storage directory (e.g.,
+	// "git/github.com/user/repo").
+	ID  string
+	VCS string
+
+	// CloneURL is the URL of the upstream repository. It is empty if it is
+	// unknown (e.g., if the mirror hasn't been accessed since the server
+	// started and its remote isn't a URL).
+	CloneURL string `json:",omitempty"`
+
+	// Size is the total size of the mirror's files, in bytes. It may be up
+	// to a minute old.
+	Size int64
+
+	// LastAccess is the time of the most recent request for the mirror since
+	// the server started.
+	LastAccess *time.Time `json:",omitempty"`
+
+	// LastUpdate is the time of the most recent successful clone or update.
+	// If there has been none since the server started, it is the mirror's
+	// last modification time.
+	LastUpdate *time.Time `json:",omitempty"`
+
+	// LastError is the error of the most recent clone or update since the
+	// server started, if it failed.
+	LastError     string     `json:",omitempty"`
+	LastErrorTime *time.Time `json:",omitempty"`
+}
+
+// mirrorState is the in-memory state of a mirror, keyed by its directory.
+type mirrorState struct {
+	cloneURL      string
+	lastAccess    time.Time
+	lastUpdate    time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// mirrorAccessed records a request for the mirror at dir of the repository at
+// cloneURL. It must only be called once the mirror exists (e.g., after a
+// successful clone), so that requests for repositories that can't be cloned
+// don't accumulate state.
+func (h *Handler) mirrorAccessed(dir, cloneURL string) {
+	h.mirrorsLock.Lock()
+	defer h.mirrorsLock.Unlock()
+	s := h.ensureMirrorState(dir)
+	s.cloneURL = cloneURL
+	s.lastAccess = time.Now()
+}
+
+// mirrorUpdated records the outcome of a clone or update of the mirror at dir.
+// Failed clones of repositories that aren't mirrored should not be recorded.
+func (h *Handler) mirrorUpdated(dir string, err error) {
+	h.mirrorsLock.Lock()
+	defer h.mirrorsLock.Unlock()
+	s := h.ensureMirrorState(dir)
+	if err != nil {
+		s.lastError, s.lastErrorTime = err.Error(), time.Now()
+	} else {
+		s.lastUpdate = time.Now()
+		s.lastError, s.lastErrorTime = "", time.Time{}
+	}
+}
+
+// forgetMirror discards the state of the (deleted) mirror at dir.
+func (h *Handler) forgetMirror(dir string) {
+	h.mirrorsLock.Lock()
+	defer h.mirrorsLock.Unlock()
+	delete(h.mirrors, dir)
+}
+
+// pruneMirrorStates discards the state of mirrors whose directories no longer
+// exist (e.g., because they were removed by an operator).
+func (h *Handler) pruneMirrorStates() {
+	h.mirrorsLock.Lock()
+	defer h.mirrorsLock.Unlock()
+	for dir := range h.mirrors {
+		if !isDir(dir) {
+			delete(h.mirrors, dir)
+		}
+	}
+}
+
+// mirrorState returns a copy of the state of the mirror at dir.
+func (h *Handler) mirrorState(dir string) mirrorState {
+	h.mirrorsLock.Lock()
+	defer h.mirrorsLock.Unlock()
+	if s, present := h.mirrors[dir]; present {
+		return *s
+	}
+	return mirrorState{}
+}
+
+func (h *Handler) ensureMirrorState(dir string) *mirrorState {
+	s, present := h.mirrors[dir]
+	if !present {
+		s = &mirrorState{}
+		h.mirrors[dir] = s
+	}
+	return s
+}
+
+// serveAdmin serves the admin API, which requires the admin scope (e.g., the
+// bearer token conf.AdminToken):
+//
+//	GET    /admin/repos           lists stored mirrors
+//	GET    /admin/repos/<id>      describes a mirror
+//	POST   /admin/repos/<id>?op=update   updates a mirror from upstream
+//	POST   /admin/repos/<id>?op=reclone  replaces a mirror with a new clone
+//	DELETE /admin/repos/<id>      deletes a mirror
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request, conf *Config) *httpError {
+	if r.URL.Path == adminReposPath || r.URL.Path == adminReposPath+"/" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			return &httpError{"method not allowed", http.StatusMethodNotAllowed}
+		}
+		mirrors, err := h.listMirrors(conf)
+		if err != nil {
+			requestLogger(r).Error("failed to list mirrors", "err", err)
+			return &httpError{"failed to list mirrors", http.StatusInternalServerError}
+		}
+		return writeAdminJSON(w, r, http.StatusOK, mirrors)
+	}
+	if !strings.HasPrefix(r.URL.Path, adminReposPath+"/") {
+		return &httpError{"not found", http.StatusNotFound}
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, adminReposPath+"/")
+	vc, dir, herr := conf.mirrorDir(id)
+	if herr != nil {
+		return herr
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if conf.Offline {
+			return &httpError{"mirrors can't be updated in offline mode", http.StatusConflict}
+		}
+		cloneURL := h.mirrorCloneURL(conf, vc, dir)
+		if cloneURL == "" {
+			return &httpError{"mirror's clone URL is unknown (access the repository first)", http.StatusConflict}
+		}
+		switch op := r.URL.Query().Get("op"); op {
+		case "update":
+			if err := h.cloneOrUpdate(r.Context(), conf, vc, dir, cloneURL, true); err != nil {
+				return h.upstreamRetryAfter(w, conf, cloneURL, err)
+			}
+		case "reclone":
+			if err := h.recloneMirror(r, conf, vc, dir, cloneURL); err != nil {
+				return h.upstreamRetryAfter(w, conf, cloneURL, err)
+			}
+		default:
+			return &httpError{"op must be update or reclone", http.StatusBadRequest}
+		}
+	case "DELETE":
+		if err := h.deleteMirror(r, conf, dir); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		return &httpError{"method not allowed", http.StatusMethodNotAllowed}
+	}
+
+	info, err := h.mirrorInfo(conf, id, vc, dir)
+	if err != nil {
+		requestLogger(r).Error("failed to describe mirror", "err", err)
+		return &httpError{"failed to describe mirror", http.StatusInternalServerError}
+	}
+	return writeAdminJSON(w, r, http.StatusOK, info)
+}
+
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) *httpError {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setNoCacheHeaders(w)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		requestLogger(r).Error("failed to write admin response", "err", err)
+	}
+	return nil
+}
+
+// mirrorDir returns the VCS and directory of the mirror identified by id. It
+// fails if id is not the (clean) path of a mirror relative to the storage
+// directory.
+func (c *Config) mirrorDir(id string) (vcs.VCS, string, *httpError) {
+	notFound := &httpError{"no such mirror", http.StatusNotFound}
+	if id == "" || path.Clean("/" + id)[1:] != id {
+		return nil, "", notFound
+	}
+	vcsName := strings.SplitN(id, "/", 2)[0]
+	vc, ok := vcs.VCSByName[vcsName]
+	if !ok || vcsName == id {
+		return nil, "", notFound
+	}
+	dir := filepath.Join(c.StorageDir, filepath.FromSlash(id))
+	if !isMirrorDir(vcsName, dir) {
+		return nil, "", notFound
+	}
+	return vc, dir, nil
+}
+
+// listMirrors returns the mirrors in the storage directory, sorted by ID.
+func (h *Handler) listMirrors(conf *Config) ([]*MirrorInfo, error) {
+	h.pruneMirrorStates()
+	mirrors := []*MirrorInfo{}
+	for _, vcsName := range []string{"git", "hg"} {
+		root := filepath.Join(conf.StorageDir, vcsName)
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if p == root && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !fi.IsDir() || p == root {
+				return nil
+			}
+			if strings.HasPrefix(fi.Name(), recloneTempPrefix) {
+				return filepath.SkipDir
+			}
+			if !isMirrorDir(vcsName, p) {
+				return nil
+			}
+			rel, err := filepath.Rel(conf.StorageDir, p)
+			if err != nil {
+				return err
+			}
+			info, err := h.mirrorInfo(conf, filepath.ToSlash(rel), vcs.VCSByName[vcsName], p)
+			if err != nil {
+				return err
+			}
+			mirrors = append(mirrors, info)
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(mirrorsByID(mirrors))
+	return mirrors, nil
+}
+
+type mirrorsByID []*MirrorInfo
+
+func (v mirrorsByID) Len() int           { return len(v) }
+func (v mirrorsByID) Less(i, j int) bool { return v[i].ID < v[j].ID }
+func (v mirrorsByID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// mirrorInfo describes the mirror at dir, which is identified by id. Its size
+// is taken from the storage usage metrics (see updateStorageUsage), so that
+// listing mirrors doesn't walk all of their files.
+func (h *Handler) mirrorInfo(conf *Config, id string, vc vcs.VCS, dir string) (*MirrorInfo, error) {
+	info := &MirrorInfo{ID: id, VCS: vc.ShortName(), CloneURL: h.mirrorCloneURL(conf, vc, dir)}
+	if size, ok := h.metrics.mirrorSize(conf.StorageDir, dir); ok {
+		info.Size = size
+	} else {
+		// The mirror is newer than the storage usage metrics.
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				info.Size += fi.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Updates modify files at the top level of the mirror (e.g., FETCH_HEAD
+	// or .hg), so there's no need to look deeper for its last modification.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var modTime time.Time
+	for _, fi := range fis {
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	s := h.mirrorState(dir)
+	if !s.lastAccess.IsZero() {
+		info.LastAccess = &s.lastAccess
+	}
+	if !s.lastUpdate.IsZero() {
+		info.LastUpdate = &s.lastUpdate
+	} else if !modTime.IsZero() {
+		info.LastUpdate = &modTime
+	}
+	if s.lastError != "" {
+		info.LastError, info.LastErrorTime = s.lastError, &s.lastErrorTime
+	}
+	return info, nil
+}
+
+// mirrorCloneURL returns the clone URL of the mirror at dir: the URL it was
+// most recently requested with or, if it hasn't been requested since the
+// server started, its remote URL (if that is a URL). It returns "" if it is
+// unknown.
+func (h *Handler) mirrorCloneURL(conf *Config, vc vcs.VCS, dir string) string {
+	if s := h.mirrorState(dir); s.cloneURL != "" {
+		return s.cloneURL
+	}
+
+	var cmd *exec.Cmd
+	switch vc {
+	case vcs.Git:
+		cmd = exec.Command(conf.GitBinary, "config", "--get", "remote.origin.url")
+	case vcs.Hg:
+		cmd = exec.Command(conf.hgBinary(), "paths", "default")
+	default:
+		return ""
+	}
+	out, err := runOutput(cmd, dir)
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(strings.TrimSpace(string(out)))
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https", "git", "ssh":
+	default:
+		return ""
+	}
+	// Mirrors of ssh:// repositories fetch as the configured SSH user.
+	u.User = nil
+	return u.String()
+}
+
+// recloneTempPrefix is the prefix of the temporary directories that mirrors
+// are moved into while they are recloned.
+const recloneTempPrefix = ".reclone-"
+
+// recloneMirror replaces the mirror at dir with a new clone of the repository
+// at cloneURL. If the clone fails, the old mirror is restored.
+func (h *Handler) recloneMirror(r *http.Request, conf *Config, vc vcs.VCS, dir, cloneURL string) *httpError {
+	mu := h.ensureRepoMutex(dir)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := h.limitUpstream(conf, cloneURL); err != nil {
+		return err
+	}
+
+	l := requestLogger(r).With("cloneURL", cloneURL, "dir", dir)
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), recloneTempPrefix)
+	if err != nil {
+		l.Error("failed to create temporary directory", "err", err)
+		return &httpError{"failed to reclone mirror", http.StatusInternalServerError}
+	}
+	defer os.RemoveAll(tmp)
+	old := filepath.Join(tmp, "old")
+
+	h.hgServers.stop(dir)
+	if err := os.Rename(dir, old); err != nil {
+		l.Error("failed to move old mirror", "err", err)
+		return &httpError{"failed to reclone mirror", http.StatusInternalServerError}
+	}
+	if err := conf.evictBlameCache(dir); err != nil {
+		l.Warn("failed to evict blame cache", "err", err)
+	}
+
+	_, span := startSpan(r.Context(), "CloneMirror")
+	start := time.Now()
+	err = conf.cloneMirror(vc, cloneURL, dir)
+	h.metrics.mirrorOp("clone", cloneURL, time.Since(start), err != nil)
+	h.mirrorUpdated(dir, err)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.Finish()
+	if err != nil {
+		l.Error("error recloning mirror (restoring old mirror)", "err", err)
+		os.RemoveAll(dir)
+		if err := os.Rename(old, dir); err != nil {
+			l.Error("failed to restore old mirror", "err", err)
+		}
+		return &httpError{"error recloning mirror", http.StatusInternalServerError}
+	}
+	l.Info("recloned mirror", "duration", time.Since(start))
+	return nil
+}
+
+// deleteMirror deletes the mirror at dir and its cached blame results.
+func (h *Handler) deleteMirror(r *http.Request, conf *Config, dir string) *httpError {
+	mu := h.ensureRepoMutex(dir)
+	mu.Lock()
+	defer mu.Unlock()
+
+	l := requestLogger(r).With("dir", dir)
+	h.hgServers.stop(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		l.Error("failed to delete mirror", "err", err)
+		return &httpError{"failed to delete mirror", http.StatusInternalServerError}
+	}
+	if err := conf.evictBlameCache(dir); err != nil {
+		l.Warn("failed to evict blame cache", "err", err)
+	}
+	h.forgetMirror(dir)
+	l.Info("deleted mirror")
+	return nil
+}
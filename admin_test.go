@@ -0,0 +1,144 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminRepos(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Store a mirror of https://example.com/repo.git.
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	mirror := makeGitRepo(t, hostDir)
+	os.RemoveAll(filepath.Join(hostDir, "work"))
+
+	h := New(nil)
+	defer h.Close()
+	conf := &Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+		AdminToken:   "secret",
+	}
+	h.SetConfig(conf)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func() []*MirrorInfo {
+		rr := do("GET", "/admin/repos", "secret")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("list: got %d: %s", rr.Code, rr.Body)
+		}
+		var mirrors []*MirrorInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &mirrors); err != nil {
+			t.Fatal(err)
+		}
+		return mirrors
+	}
+
+	if rr := do("GET", "/admin/repos", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", rr.Code)
+	}
+	if rr := do("GET", "/admin/repos", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("with wrong token: got %d, want 401", rr.Code)
+	}
+
+	mirrors := list()
+	if len(mirrors) != 1 {
+		t.Fatalf("got %d mirrors, want 1", len(mirrors))
+	}
+	m := mirrors[0]
+	if m.ID != "git/example.com/repo.git" || m.VCS != "git" || m.Size == 0 || m.LastUpdate == nil {
+		t.Errorf("got mirror %+v", m)
+	}
+	if m.LastAccess != nil || m.CloneURL != "" {
+		t.Errorf("got access or clone URL of unaccessed mirror: %+v", m)
+	}
+
+	// Accessing the repository records its clone URL and access time.
+	if rr := do("GET", "/git/https/example.com/repo.git/api/blame/master/foo", ""); rr.Code != http.StatusOK {
+		t.Fatalf("blame: got %d: %s", rr.Code, rr.Body)
+	}
+	rr := do("GET", "/admin/repos/git/example.com/repo.git", "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get: got %d: %s", rr.Code, rr.Body)
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.CloneURL != "https://example.com/repo.git" || m.LastAccess == nil {
+		t.Errorf("got mirror %+v after access", m)
+	}
+
+	// Requests for repositories that aren't mirrored record no state.
+	do("GET", "/git/https/example.com/nonexistent.git/api/blame/master/foo", "")
+	h.mirrorsLock.Lock()
+	n := len(h.mirrors)
+	h.mirrorsLock.Unlock()
+	if n != 1 {
+		t.Errorf("got state for %d mirrors, want 1", n)
+	}
+
+	for _, path := range []string{"/admin/repos/git/example.com/nonexistent.git", "/admin/repos/git/example.com/../example.com/repo.git", "/admin/repos/git", "/admin/other"} {
+		if rr := do("GET", path, "secret"); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, rr.Code)
+		}
+	}
+	if rr := do("POST", "/admin/repos/git/example.com/repo.git?op=update", "secret"); rr.Code != http.StatusConflict {
+		t.Errorf("update in offline mode: got %d, want 409", rr.Code)
+	}
+
+	// A failed reclone keeps the old mirror.
+	online := *conf
+	online.Offline = false
+	online.AccessPolicy = *HostsPolicy([]string{"example.invalid"})
+	h.SetConfig(&online)
+	h.mirrorAccessed(mirror, "https://example.invalid/repo.git")
+	if rr := do("POST", "/admin/repos/git/example.com/repo.git?op=reclone", "secret"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("failed reclone: got %d, want 500", rr.Code)
+	}
+	if !isMirrorDir("git", mirror) {
+		t.Error("old mirror was not restored after failed reclone")
+	}
+	if mirrors := list(); len(mirrors) != 1 || mirrors[0].LastError == "" {
+		t.Errorf("got mirrors %+v after failed reclone, want 1 with error", mirrors)
+	}
+
+	if rr := do("DELETE", "/admin/repos/git/example.com/repo.git", "secret"); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d: %s", rr.Code, rr.Body)
+	}
+	if isDir(mirror) {
+		t.Error("mirror was not deleted")
+	}
+	if mirrors := list(); len(mirrors) != 0 {
+		t.Errorf("got %d mirrors after delete, want 0", len(mirrors))
+	}
+
+	// The state of mirrors removed outside of the admin API is discarded.
+	h.mirrorUpdated(filepath.Join(hostDir, "removed.git"), nil)
+	list()
+	if s := h.mirrorState(filepath.Join(hostDir, "removed.git")); !s.lastUpdate.IsZero() {
+		t.Error("state of removed mirror was not discarded")
+	}
+}
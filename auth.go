@@ -0,0 +1,330 @@
+package vcsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to an authenticated user.
+type Scope string
+
+const (
+	// ScopeRead allows reading files (via /v/ and /v-batch/ paths).
+	ScopeRead Scope = "read"
+
+	// ScopeClone allows cloning and fetching (and forwarded pushes) using
+	// the git and hg protocols.
+	ScopeClone Scope = "clone"
+
+	// ScopeBlame allows the blame and authorship APIs.
+	ScopeBlame Scope = "blame"
+
+	// ScopeAdmin allows the admin API.
+	ScopeAdmin Scope = "admin"
+)
+
+// scope returns the scope required to perform action a.
+func (a action) scope() Scope {
+	switch a {
+	case proxyAction:
+		return ScopeClone
+	case singleFileAction, batchFileAction:
+		return ScopeRead
+	case blameAction, fileBlameAction, authorshipAction:
+		return ScopeBlame
+	}
+	return ScopeAdmin
+}
+
+// Identity is an authenticated user and the scopes granted to them.
+type Identity struct {
+	User   string
+	Scopes []Scope
+
+	// issued is whether the user's credentials were issued by vcsserver
+	// (e.g., a StaticAuthenticator token), rather than by an upstream host.
+	// Issued credentials are never sent upstream.
+	issued bool
+}
+
+// HasScope reports whether s is one of i's scopes.
+func (i *Identity) HasScope(s Scope) bool {
+	for _, scope := range i.Scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials are the credentials sent with a request, in an Authorization
+// header with the Bearer or Basic scheme.
+type Credentials struct {
+	Token    string `json:",omitempty"` // bearer token
+	Username string `json:",omitempty"` // HTTP basic
+	Password string `json:",omitempty"` // HTTP basic
+}
+
+// An Authenticator authenticates the senders of requests. If a Handler's
+// Authenticator is non-nil, all requests (except those for metrics and health
+// checks) must be authenticated, and the user must have the scope required by
+// the request.
+type Authenticator interface {
+	// Authenticate returns the identity of the user with the specified
+	// credentials, or nil if they are invalid. It returns an error only if
+	// the credentials can't be checked (e.g., an auth service is down).
+	Authenticate(ctx context.Context, creds *Credentials) (*Identity, error)
+}
+
+// requestCredentials returns the credentials in r's Authorization header, or
+// nil if there are none.
+func requestCredentials(r *http.Request) *Credentials {
+	if username, password, ok := r.BasicAuth(); ok {
+		return &Credentials{Username: username, Password: password}
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return &Credentials{Token: strings.TrimSpace(auth[len(prefix):])}
+	}
+	return nil
+}
+
+// authenticate returns the identity of r's sender. The bearer token
+// conf.AdminToken (if set) authenticates an admin; other credentials are
+// checked by h.Authenticator. If the credentials are missing or invalid, it
+// returns a nil identity.
+func (h *Handler) authenticate(r *http.Request, conf *Config) (*Identity, *httpError) {
+	creds := requestCredentials(r)
+	if creds == nil {
+		return nil, nil
+	}
+	if conf.AdminToken != "" && creds.Token != "" && subtle.ConstantTimeCompare([]byte(creds.Token), []byte(conf.AdminToken)) == 1 {
+		return &Identity{User: "admin", Scopes: []Scope{ScopeAdmin}, issued: true}, nil
+	}
+	if h.Authenticator == nil {
+		return nil, nil
+	}
+	ident, err := h.Authenticator.Authenticate(r.Context(), creds)
+	if err != nil {
+		requestLogger(r).Error("authentication failed", "err", err)
+		return nil, &httpError{"authentication is unavailable", http.StatusServiceUnavailable}
+	}
+	return ident, nil
+}
+
+// authorize checks that ident may perform action. If authentication is
+// disabled (h.Authenticator is nil), only the admin API requires an identity.
+func (h *Handler) authorize(w http.ResponseWriter, conf *Config, ident *Identity, action action) *httpError {
+	if h.Authenticator == nil && action != adminAction {
+		return nil
+	}
+	if ident == nil {
+		if action == adminAction && h.Authenticator == nil && conf.AdminToken == "" {
+			return &httpError{"admin API is disabled", http.StatusNotFound}
+		}
+		// git and hg prompt for a username and password in response to a
+		// Basic challenge.
+		w.Header().Add("WWW-Authenticate", `Basic realm="vcsserver"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="vcsserver"`)
+		return &httpError{"authentication required", http.StatusUnauthorized}
+	}
+	if !ident.HasScope(action.scope()) {
+		return &httpError{fmt.Sprintf("user %q lacks the %q scope", ident.User, action.scope()), http.StatusForbidden}
+	}
+	return nil
+}
+
+type identityKey struct{}
+
+// withIdentity returns a copy of r whose context carries the authenticated
+// identity of its sender.
+func withIdentity(r *http.Request, ident *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, ident))
+}
+
+// requestIdentity returns the authenticated identity of r's sender, or nil if
+// it was not authenticated.
+func requestIdentity(r *http.Request) *Identity {
+	ident, _ := r.Context().Value(identityKey{}).(*Identity)
+	return ident
+}
+
+// StaticAuthenticator authenticates users with a fixed set of tokens and
+// passwords.
+type StaticAuthenticator struct {
+	// Tokens maps bearer tokens to the identities they authenticate. Tokens
+	// are also accepted as HTTP basic passwords (with any username), which
+	// git and hg clients can send.
+	Tokens map[string]*Identity
+
+	// Users maps the usernames of HTTP basic users to their passwords and
+	// scopes.
+	Users map[string]*StaticUser
+}
+
+// StaticUser is a user authenticated by a StaticAuthenticator with HTTP basic
+// auth.
+type StaticUser struct {
+	Password string
+	Scopes   []Scope
+}
+
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, creds *Credentials) (*Identity, error) {
+	if creds.Username != "" {
+		if u, present := a.Users[creds.Username]; present && subtle.ConstantTimeCompare([]byte(creds.Password), []byte(u.Password)) == 1 {
+			return &Identity{User: creds.Username, Scopes: u.Scopes, issued: true}, nil
+		}
+	}
+	token := creds.Token
+	if token == "" {
+		token = creds.Password
+	}
+	for t, ident := range a.Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			issuedIdent := *ident
+			issuedIdent.issued = true
+			return &issuedIdent, nil
+		}
+	}
+	return nil, nil
+}
+
+// WebhookAuthenticator delegates authentication to an HTTP service. It POSTs
+// the request's Credentials as JSON to URL. If the service responds with HTTP
+// 200 OK, the response body is the JSON-encoded Identity of the user; if it
+// responds with HTTP 401 or 403, the credentials are invalid.
+type WebhookAuthenticator struct {
+	URL string
+
+	// CacheTTL is how long the service's responses are cached for. If zero,
+	// every request is authenticated by the service.
+	CacheTTL Duration
+
+	// Client is the HTTP client used to contact the service. If nil, a client
+	// with a 10-second timeout is used.
+	Client *http.Client `json:"-"`
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*webhookResult
+}
+
+type webhookResult struct {
+	ident   *Identity
+	expires time.Time
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (a *WebhookAuthenticator) Authenticate(ctx context.Context, creds *Credentials) (*Identity, error) {
+	body, err := json.Marshal(creds)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(body)
+	if a.CacheTTL.Duration > 0 {
+		a.mu.Lock()
+		res, present := a.cache[key]
+		a.mu.Unlock()
+		if present && time.Now().Before(res.expires) {
+			return res.ident, nil
+		}
+	}
+
+	req, err := http.NewRequest("POST", a.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceparent(ctx, req.Header)
+	client := a.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ident *Identity
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ident = &Identity{}
+		if err := json.NewDecoder(resp.Body).Decode(ident); err != nil {
+			return nil, fmt.Errorf("auth webhook: bad response: %s", err)
+		}
+	case http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return nil, fmt.Errorf("auth webhook: unexpected status %s", resp.Status)
+	}
+
+	if a.CacheTTL.Duration > 0 {
+		a.mu.Lock()
+		if a.cache == nil {
+			a.cache = make(map[[sha256.Size]byte]*webhookResult)
+		}
+		now := time.Now()
+		for k, res := range a.cache {
+			if now.After(res.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.cache[key] = &webhookResult{ident: ident, expires: now.Add(a.CacheTTL.Duration)}
+		a.mu.Unlock()
+	}
+	return ident, nil
+}
+
+// MultiAuthenticator authenticates users with each of its Authenticators in
+// turn, until one accepts the credentials.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(ctx context.Context, creds *Credentials) (*Identity, error) {
+	for _, a := range m {
+		ident, err := a.Authenticate(ctx, creds)
+		if ident != nil || err != nil {
+			return ident, err
+		}
+	}
+	return nil, nil
+}
+
+// LoadAuthenticator reads a JSON-encoded authentication config from the named
+// file. The config contains the fields of a StaticAuthenticator and,
+// optionally, a Webhook (a WebhookAuthenticator) that is consulted for
+// credentials that the static tokens and users don't match.
+func LoadAuthenticator(filename string) (Authenticator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c struct {
+		StaticAuthenticator
+		Webhook *WebhookAuthenticator
+	}
+	err = json.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	m := MultiAuthenticator{&c.StaticAuthenticator}
+	if c.Webhook != nil {
+		if c.Webhook.URL == "" {
+			return nil, fmt.Errorf("auth webhook has no URL")
+		}
+		m = append(m, c.Webhook)
+	}
+	return m, nil
+}
@@ -0,0 +1,155 @@
+package vcsserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := &StaticAuthenticator{
+		Tokens: map[string]*Identity{"t0ken": {User: "ci", Scopes: []Scope{ScopeClone}}},
+		Users:  map[string]*StaticUser{"alice": {Password: "pw", Scopes: []Scope{ScopeRead, ScopeBlame}}},
+	}
+	tests := []struct {
+		creds    Credentials
+		wantUser string // "" means invalid
+	}{
+		{Credentials{Token: "t0ken"}, "ci"},
+		{Credentials{Username: "x", Password: "t0ken"}, "ci"},
+		{Credentials{Username: "alice", Password: "pw"}, "alice"},
+		{Credentials{Username: "alice", Password: "wrong"}, ""},
+		{Credentials{Username: "bob", Password: "pw"}, ""},
+		{Credentials{Token: "pw"}, ""},
+		{Credentials{Username: "alice"}, ""},
+	}
+	for _, test := range tests {
+		ident, err := a.Authenticate(context.Background(), &test.creds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user := identUser(ident); user != test.wantUser {
+			t.Errorf("%+v: got user %q, want %q", test.creds, user, test.wantUser)
+		}
+	}
+}
+
+func identUser(ident *Identity) string {
+	if ident == nil {
+		return ""
+	}
+	return ident.User
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			t.Error(err)
+		}
+		switch creds.Token {
+		case "good":
+			json.NewEncoder(w).Encode(&Identity{User: "u", Scopes: []Scope{ScopeRead}})
+		case "bad":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	a := &WebhookAuthenticator{URL: ts.URL, CacheTTL: Duration{time.Minute}}
+	for i := 0; i < 2; i++ {
+		ident, err := a.Authenticate(context.Background(), &Credentials{Token: "good"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ident == nil || ident.User != "u" || !ident.HasScope(ScopeRead) || ident.HasScope(ScopeAdmin) {
+			t.Errorf("got identity %+v", ident)
+		}
+		if ident, err := a.Authenticate(context.Background(), &Credentials{Token: "bad"}); err != nil || ident != nil {
+			t.Errorf("bad token: got %+v, %v", ident, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d webhook calls, want 2 (results should be cached)", calls)
+	}
+	if _, err := a.Authenticate(context.Background(), &Credentials{Token: "error"}); err == nil {
+		t.Error("got no error when webhook failed")
+	}
+}
+
+func TestHandler_Auth(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	makeGitRepo(t, hostDir)
+
+	authFile := filepath.Join(tmpdir, "auth.json")
+	if err := ioutil.WriteFile(authFile, []byte(`{
+		"Tokens": {
+			"blame-token": {"User": "blamer", "Scopes": ["blame"]},
+			"admin-token": {"User": "root", "Scopes": ["admin"]}
+		},
+		"Users": {"alice": {"Password": "pw", "Scopes": ["read", "clone"]}}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuthenticator(authFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(nil)
+	defer h.Close()
+	h.Authenticator = auth
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+	})
+
+	const blamePath = "/git/https/example.com/repo.git/api/blame/master/foo"
+	tests := []struct {
+		path     string
+		setAuth  func(*http.Request)
+		wantCode int
+	}{
+		{blamePath, func(*http.Request) {}, http.StatusUnauthorized},
+		{blamePath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{blamePath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer blame-token") }, http.StatusOK},
+		{blamePath, func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusForbidden},
+		{blamePath, func(r *http.Request) { r.SetBasicAuth("git", "blame-token") }, http.StatusOK},
+		{"/admin/repos", func(r *http.Request) { r.Header.Set("Authorization", "Bearer blame-token") }, http.StatusForbidden},
+		{"/admin/repos", func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-token") }, http.StatusOK},
+		{"/healthz", func(*http.Request) {}, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		test.setAuth(req)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.wantCode {
+			t.Errorf("%s %v: got %d, want %d: %s", test.path, req.Header, rr.Code, test.wantCode, rr.Body)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: got no WWW-Authenticate challenge", test.path)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"github.com/sourcegraph/go-vcs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuthorStats describes how much of a repository (or directory) an author
+// last changed.
+type AuthorStats struct {
+	AuthorName  string
+	AuthorEmail string
+
+	// Chars is the number of characters last changed by the author, and
+	// Percent is the percentage of all characters that it makes up.
+	Chars   int
+	Percent float64
+
+	// LastTouched is the latest author date of the author's commits that
+	// last changed any of the characters.
+	LastTouched time.Time
+}
+
+// DirAuthorship is the authorship of a top-level directory of a repository.
+// Files in the repository's root directory are counted in the directory ".".
+type DirAuthorship struct {
+	Dir     string
+	Chars   int
+	Authors []*AuthorStats
+}
+
+// AuthorshipResponse is the response to an authorship request. Authors are
+// sorted by decreasing Chars.
+type AuthorshipResponse struct {
+	CommitID string
+	Chars    int
+	Authors  []*AuthorStats
+
+	// Dirs is the authorship of each top-level directory, sorted by name. It
+	// is only set if requested with ?by=dir.
+	Dirs []*DirAuthorship `json:",omitempty"`
+
+	// Skipped is the sorted list of paths of files that were not counted
+	// because they were ignored (see BlameResponse).
+	Skipped []string
+}
+
+// authorship handles requests for /api/authorship, which summarizes the blame
+// of the repository by author. It accepts the same query parameters as
+// /api/blame (v, ignore and include), and by=dir to also summarize each
+// top-level directory.
+func authorship(w http.ResponseWriter, r *http.Request, conf *Config, vc vcs.VCS, dir string) *httpError {
+	q := r.URL.Query()
+	v := q.Get("v")
+	if v != "" {
+		if herr := checkRev(v); herr != nil {
+			return herr
+		}
+	}
+	byDir := false
+	switch q.Get("by") {
+	case "":
+	case "dir":
+		byDir = true
+	default:
+		return &httpError{"by must be empty or dir", http.StatusBadRequest}
+	}
+	filter, herr := newBlameFilter(r, conf)
+	if herr != nil {
+		return herr
+	}
+
+	_, span := startSpan(r.Context(), "authorship")
+	defer span.Finish()
+
+	commitID, err := conf.resolveCommit(vc, dir, v)
+	if err != nil {
+		requestLogger(r).Error("failed to blame repository", "err", err)
+		return &httpError{"failed to blame repository", http.StatusInternalServerError}
+	}
+	data, err := conf.cachedBlameRepository(requestLogger(r), vc, dir, commitID, filter)
+	if err != nil {
+		requestLogger(r).Error("failed to blame repository", "err", err)
+		return &httpError{"failed to blame repository", http.StatusInternalServerError}
+	}
+
+	resp := aggregateAuthorship(data, byDir)
+	resp.CommitID = commitID
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		requestLogger(r).Error("failed to write response", "err", err)
+		// too late to return an HTTP error
+	}
+	return nil
+}
+
+// aggregateAuthorship sums the character ranges of the hunks in data by
+// author (and, if byDir, by top-level directory and author). Authors are
+// identified by their email address, ignoring case, or by their name if they
+// have none.
+func aggregateAuthorship(data *BlameResponse, byDir bool) *AuthorshipResponse {
+	commits := make(map[string]*Commit, len(data.Commits))
+	for _, c := range data.Commits {
+		commits[c.CommitID] = c
+	}
+
+	total := newAuthorCounter()
+	dirs := make(map[string]*authorCounter)
+	for _, hunk := range data.Hunks {
+		c := commits[hunk.CommitID]
+		if c == nil {
+			c = &Commit{CommitID: hunk.CommitID}
+		}
+		n := hunk.End - hunk.Start
+		total.add(c, n)
+		if byDir {
+			d := topLevelDir(hunk.File)
+			if dirs[d] == nil {
+				dirs[d] = newAuthorCounter()
+			}
+			dirs[d].add(c, n)
+		}
+	}
+
+	resp := &AuthorshipResponse{Chars: total.chars, Authors: total.stats(), Skipped: data.Skipped}
+	if resp.Skipped == nil {
+		resp.Skipped = []string{}
+	}
+	if byDir {
+		resp.Dirs = make([]*DirAuthorship, 0, len(dirs))
+		for d, counter := range dirs {
+			resp.Dirs = append(resp.Dirs, &DirAuthorship{Dir: d, Chars: counter.chars, Authors: counter.stats()})
+		}
+		sort.Sort(dirAuthorshipsByName(resp.Dirs))
+	}
+	return resp
+}
+
+// topLevelDir returns the first component of the file path p, or "." if p is
+// in the root directory.
+func topLevelDir(p string) string {
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i]
+	}
+	return "."
+}
+
+type authorCounter struct {
+	chars   int
+	authors map[string]*AuthorStats
+}
+
+func newAuthorCounter() *authorCounter {
+	return &authorCounter{authors: make(map[string]*AuthorStats)}
+}
+
+func (c *authorCounter) add(commit *Commit, chars int) {
+	key := strings.ToLower(commit.AuthorEmail)
+	if key == "" {
+		key = "name:" + commit.AuthorName
+	}
+	a := c.authors[key]
+	if a == nil {
+		a = &AuthorStats{AuthorName: commit.AuthorName, AuthorEmail: commit.AuthorEmail}
+		c.authors[key] = a
+	}
+	a.Chars += chars
+	if commit.AuthorDate.After(a.LastTouched) {
+		a.LastTouched = commit.AuthorDate
+		// Use the author's most recent name and email address.
+		a.AuthorName, a.AuthorEmail = commit.AuthorName, commit.AuthorEmail
+	}
+	c.chars += chars
+}
+
+// stats returns the authors' stats, sorted by decreasing Chars.
+func (c *authorCounter) stats() []*AuthorStats {
+	stats := make([]*AuthorStats, 0, len(c.authors))
+	for _, a := range c.authors {
+		if c.chars > 0 {
+			a.Percent = 100 * float64(a.Chars) / float64(c.chars)
+		}
+		stats = append(stats, a)
+	}
+	sort.Sort(authorStatsByChars(stats))
+	return stats
+}
+
+type authorStatsByChars []*AuthorStats
+
+func (v authorStatsByChars) Len() int      { return len(v) }
+func (v authorStatsByChars) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v authorStatsByChars) Less(i, j int) bool {
+	if v[i].Chars != v[j].Chars {
+		return v[i].Chars > v[j].Chars
+	}
+	return v[i].AuthorEmail+v[i].AuthorName < v[j].AuthorEmail+v[j].AuthorName
+}
+
+type dirAuthorshipsByName []*DirAuthorship
+
+func (v dirAuthorshipsByName) Len() int           { return len(v) }
+func (v dirAuthorshipsByName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v dirAuthorshipsByName) Less(i, j int) bool { return v[i].Dir < v[j].Dir }
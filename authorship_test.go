@@ -0,0 +1,112 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestAggregateAuthorship(t *testing.T) {
+	t1 := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	data := &BlameResponse{
+		Commits: []*Commit{
+			{CommitID: "a1", AuthorName: "Alice", AuthorEmail: "alice@example.com", AuthorDate: t1},
+			{CommitID: "a2", AuthorName: "Alice Smith", AuthorEmail: "Alice@Example.com", AuthorDate: t2},
+			{CommitID: "b1", AuthorName: "Bob", AuthorEmail: "bob@example.com", AuthorDate: t1},
+		},
+		Hunks: []*Hunk{
+			{CommitID: "a1", File: "README", Start: 0, End: 10},
+			{CommitID: "b1", File: "README", Start: 10, End: 20},
+			{CommitID: "a2", File: "src/a.go", Start: 0, End: 50},
+			{CommitID: "b1", File: "src/b/b.go", Start: 0, End: 30},
+		},
+		Skipped: []string{"vendor/x.go"},
+	}
+
+	want := &AuthorshipResponse{
+		Chars: 100,
+		Authors: []*AuthorStats{
+			{AuthorName: "Alice Smith", AuthorEmail: "Alice@Example.com", Chars: 60, Percent: 60, LastTouched: t2},
+			{AuthorName: "Bob", AuthorEmail: "bob@example.com", Chars: 40, Percent: 40, LastTouched: t1},
+		},
+		Skipped: []string{"vendor/x.go"},
+	}
+	if got := aggregateAuthorship(data, false); !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("want %s, got %s", wantJSON, gotJSON)
+	}
+
+	got := aggregateAuthorship(data, true)
+	wantDirs := []*DirAuthorship{
+		{Dir: ".", Chars: 20, Authors: []*AuthorStats{
+			{AuthorName: "Alice", AuthorEmail: "alice@example.com", Chars: 10, Percent: 50, LastTouched: t1},
+			{AuthorName: "Bob", AuthorEmail: "bob@example.com", Chars: 10, Percent: 50, LastTouched: t1},
+		}},
+		{Dir: "src", Chars: 80, Authors: []*AuthorStats{
+			{AuthorName: "Alice Smith", AuthorEmail: "Alice@Example.com", Chars: 50, Percent: 62.5, LastTouched: t2},
+			{AuthorName: "Bob", AuthorEmail: "bob@example.com", Chars: 30, Percent: 37.5, LastTouched: t1},
+		}},
+	}
+	if !reflect.DeepEqual(got.Dirs, wantDirs) {
+		gotJSON, _ := json.Marshal(got.Dirs)
+		wantJSON, _ := json.Marshal(wantDirs)
+		t.Errorf("want dirs %s, got %s", wantJSON, gotJSON)
+	}
+}
+
+func TestAuthorship_Cached(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-authorship")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := makeGitRepo(t, tmpdir)
+	conf := &Config{StorageDir: tmpdir, GitBinary: GitBinary}
+	commitID, err := conf.resolveCommit(vcs.Git, dir, "master")
+	if err != nil {
+		t.Fatal("resolveCommit:", err)
+	}
+
+	// Authorship is computed from the same (cached) blame as /api/blame.
+	blame := &BlameResponse{
+		Commits: []*Commit{{CommitID: commitID, AuthorName: "a", AuthorEmail: "a@example.com"}},
+		Hunks:   []*Hunk{{CommitID: commitID, File: "foo", Start: 0, End: 14}},
+		Skipped: []string{},
+	}
+	b, _ := json.Marshal(blame)
+	if err := writeBlameCache(conf.blameCacheFile(dir, commitID, (&blameFilter{}).cacheKey()), b); err != nil {
+		t.Fatal("writeBlameCache:", err)
+	}
+
+	for _, url := range []string{"/api/authorship?v=master&by=dir", "/api/authorship?by=foo"} {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if herr := authorship(w, r, conf, vcs.Git, dir); herr != nil {
+			if url == "/api/authorship?by=foo" && herr.statusCode == http.StatusBadRequest {
+				continue
+			}
+			t.Fatalf("%s: authorship: %s", url, herr.message)
+		}
+
+		var resp AuthorshipResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.CommitID != commitID || resp.Chars != 14 || len(resp.Authors) != 1 || resp.Authors[0].Percent != 100 {
+			t.Errorf("%s: unexpected response %s", url, w.Body.Bytes())
+		}
+		if len(resp.Dirs) != 1 || resp.Dirs[0].Dir != "." {
+			t.Errorf("%s: want dir \".\", got %+v", url, resp.Dirs)
+		}
+	}
+}
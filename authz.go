@@ -0,0 +1,325 @@
+package vcsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Authorizer decides whether a user may access a repository. If a
+// Handler's Authorizer is non-nil, it is consulted for every repository
+// request (after the access policy and the user's scopes are checked).
+type Authorizer interface {
+	// Authorize reports whether the request described by req may access the
+	// repository. It returns an error only if access can't be determined
+	// (e.g., an upstream server is down).
+	Authorize(ctx context.Context, req *AuthorizationRequest) (bool, error)
+}
+
+// AuthorizationRequest describes a request for access to a repository.
+type AuthorizationRequest struct {
+	// Identity is the authenticated user, or nil if authentication is
+	// disabled.
+	Identity *Identity
+
+	// Credentials are the credentials sent with the request, or nil if there
+	// were none or they were issued by vcsserver (e.g., a StaticAuthenticator
+	// token), so that an Authorizer never sends vcsserver's own credentials
+	// upstream.
+	Credentials *Credentials
+
+	VCS      string // "git" or "hg"
+	CloneURL string
+}
+
+// authorizeRepo checks that h.Authorizer (if any) allows the request r to
+// access the repository at route. If access is denied to a request without
+// credentials, clients are challenged to send them.
+func (h *Handler) authorizeRepo(w http.ResponseWriter, r *http.Request, route *route) *httpError {
+	if h.Authorizer == nil {
+		return nil
+	}
+	creds := requestCredentials(r)
+	req := &AuthorizationRequest{
+		Identity: requestIdentity(r),
+		VCS:      route.vcs.ShortName(),
+		CloneURL: route.cloneURL,
+	}
+	if req.Identity == nil || !req.Identity.issued {
+		req.Credentials = creds
+	}
+	_, span := startSpan(r.Context(), "authorize")
+	allowed, err := h.Authorizer.Authorize(r.Context(), req)
+	span.SetAttribute("allowed", allowed)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.Finish()
+	if err != nil {
+		requestLogger(r).Error("authorization failed", "cloneURL", route.cloneURL, "err", err)
+		return &httpError{"authorization is unavailable", http.StatusServiceUnavailable}
+	}
+	if !allowed {
+		if creds == nil {
+			w.Header().Add("WWW-Authenticate", `Basic realm="vcsserver"`)
+			return &httpError{"authentication required", http.StatusUnauthorized}
+		}
+		return &httpError{"access to specified repository is not allowed", http.StatusForbidden}
+	}
+	return nil
+}
+
+// CachedAuthorizer caches the decisions of an Authorizer for each user,
+// clone URL and set of credentials.
+type CachedAuthorizer struct {
+	Authorizer Authorizer
+
+	// TTL is how long decisions are cached for.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*authzResult
+}
+
+type authzResult struct {
+	allowed bool
+	expires time.Time
+}
+
+func (a *CachedAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest) (bool, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	key := sha256.Sum256(b)
+
+	a.mu.Lock()
+	res, present := a.cache[key]
+	a.mu.Unlock()
+	if present && time.Now().Before(res.expires) {
+		return res.allowed, nil
+	}
+
+	allowed, err := a.Authorizer.Authorize(ctx, req)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cache == nil {
+		a.cache = make(map[[sha256.Size]byte]*authzResult)
+	}
+	now := time.Now()
+	for k, res := range a.cache {
+		if now.After(res.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = &authzResult{allowed: allowed, expires: now.Add(a.TTL)}
+	return allowed, nil
+}
+
+// LsRemoteAuthorizer allows access to a repository if the user can list its
+// refs on the upstream server, using the request's credentials (e.g., a
+// username and password, or a token, for the upstream host, sent with HTTP
+// basic auth). Requests without credentials may only access public
+// repositories.
+//
+// The credentials that clients send to vcsserver are forwarded to the
+// upstream host, so clients must authenticate with their upstream
+// credentials. Credentials issued by vcsserver itself (by a
+// StaticAuthenticator or Config.AdminToken) are not forwarded; requests with
+// them may only access public repositories.
+//
+// If the upstream host denies access (or the repository doesn't exist),
+// access is denied. If the host can't be reached or fails (e.g., with an HTTP
+// 5xx error), Authorize returns an error.
+//
+// Repositories with git:// clone URLs (which are always public) may be
+// accessed by anyone. Access to repositories with ssh:// clone URLs, which are
+// fetched with the server's own SSH key, is denied.
+type LsRemoteAuthorizer struct {
+	// GitBinary and HgBinary are the paths to the git and hg executables. If
+	// empty, the package variables GitBinary and HgBinary are used.
+	GitBinary string
+	HgBinary  string
+
+	// TokenUsername is the username sent upstream with bearer tokens (which
+	// are sent as HTTP basic passwords). If empty, "x-access-token" is used.
+	TokenUsername string
+
+	// Timeout is the maximum duration of an upstream check. If zero, it is
+	// 30 seconds.
+	Timeout time.Duration
+}
+
+func (a *LsRemoteAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest) (bool, error) {
+	u, err := url.Parse(req.CloneURL)
+	if err != nil {
+		return false, err
+	}
+	switch u.Scheme {
+	case "git":
+		return true, nil
+	case "http", "https":
+	default:
+		return false, nil
+	}
+
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var username, password string
+	if c := req.Credentials; c != nil {
+		username, password = c.Username, c.Password
+		if c.Token != "" {
+			username, password = a.TokenUsername, c.Token
+			if username == "" {
+				username = "x-access-token"
+			}
+		}
+	}
+
+	var cmd *exec.Cmd
+	switch req.VCS {
+	case "git":
+		cmd, err = a.gitLsRemote(ctx, req.CloneURL, username, password)
+	case "hg":
+		var cleanup func()
+		cmd, cleanup, err = a.hgIdentify(ctx, u, username, password)
+		if cleanup != nil {
+			defer cleanup()
+		}
+	default:
+		return false, fmt.Errorf("unsupported VCS %q", req.VCS)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("checking access to %s: %s", req.CloneURL, ctx.Err())
+	}
+	if _, exited := err.(*exec.ExitError); exited {
+		if isAccessDenied(stderr.String()) {
+			// The repository doesn't exist, or the credentials don't
+			// grant access to it.
+			return false, nil
+		}
+		return false, fmt.Errorf("checking access to %s: %s: %s", req.CloneURL, err, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// accessDeniedMessages are substrings of the error messages of git ls-remote
+// and hg identify (with LC_ALL=C and HGPLAIN=1) that mean the upstream host
+// denied access to the repository or it doesn't exist, as opposed to failing.
+var accessDeniedMessages = []string{
+	// git
+	"Authentication failed",
+	"could not read Username",
+	"could not read Password",
+	"returned error: 401",
+	"returned error: 403",
+	"returned error: 404",
+	"' not found",
+
+	// hg
+	"authorization required",
+	"authorization failed",
+	"HTTP Error 401",
+	"HTTP Error 403",
+	"HTTP Error 404",
+	"does not appear to be an hg repository",
+}
+
+// isAccessDenied reports whether stderr, the error output of a failed upstream
+// check, means that access was denied.
+func isAccessDenied(stderr string) bool {
+	for _, msg := range accessDeniedMessages {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitLsRemote returns a command that lists the HEAD ref of the repository at
+// cloneURL. The credentials are passed to git by a credential helper that
+// reads them from the environment, so that they don't appear in the command
+// line.
+func (a *LsRemoteAuthorizer) gitLsRemote(ctx context.Context, cloneURL, username, password string) (*exec.Cmd, error) {
+	gitBinary := a.GitBinary
+	if gitBinary == "" {
+		gitBinary = GitBinary
+	}
+	args := []string{"-c", "credential.helper="}
+	env := append(os.Environ(), "LC_ALL=C", "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=true", "SSH_ASKPASS=true")
+	if username != "" || password != "" {
+		args = append(args, "-c", `credential.helper=!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$VCSSERVER_USERNAME" "$VCSSERVER_PASSWORD"; }; f`)
+		env = append(env, "VCSSERVER_USERNAME="+username, "VCSSERVER_PASSWORD="+password)
+	}
+	args = append(args, "ls-remote", "--", cloneURL, "HEAD")
+	cmd := exec.CommandContext(ctx, gitBinary, args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// hgIdentify returns a command that identifies the tip of the repository at
+// cloneURL. The credentials are passed to hg in a temporary hgrc file, so that
+// they don't appear in the command line; the returned cleanup function removes
+// it.
+func (a *LsRemoteAuthorizer) hgIdentify(ctx context.Context, cloneURL *url.URL, username, password string) (*exec.Cmd, func(), error) {
+	hgBinary := a.HgBinary
+	if hgBinary == "" {
+		hgBinary = HgBinary
+	}
+	f, err := ioutil.TempFile("", "vcsserver-hgrc-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	hgrc := "[ui]\ninteractive = false\n"
+	if username != "" || password != "" {
+		prefix := cloneURL.Scheme + "://" + cloneURL.Host
+		hgrc += fmt.Sprintf("\n[auth]\nvcsserver.prefix = %s\nvcsserver.username = %s\nvcsserver.password = %s\n", prefix, hgrcValue(username), hgrcValue(password))
+	}
+	_, err = f.WriteString(hgrc)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	cmd := exec.CommandContext(ctx, hgBinary, "identify", "--", cloneURL.String())
+	cmd.Env = append(os.Environ(), "HGRCPATH="+f.Name(), "HGPLAIN=1", "LC_ALL=C")
+	return cmd, cleanup, nil
+}
+
+// hgrcValue strips line breaks from s, which would otherwise start a new hgrc
+// setting.
+func hgrcValue(s string) string {
+	return strings.NewReplacer("\n", "", "\r", "").Replace(s)
+}
@@ -0,0 +1,194 @@
+package vcsserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLsRemoteAuthorizer_Git(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Serve a private repository that alice (or the token "tok") may access.
+	repoDir := makeGitRepo(t, tmpdir)
+	conf := &Config{GitBinary: GitBinary}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/unavailable.git/") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/forbidden.git/") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		username, password, _ := r.BasicAuth()
+		if !(username == "alice" && password == "pw") && !(username == "x-access-token" && password == "tok") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ok, err := serveGitSmartHTTP(w, r, conf, repoDir, strings.TrimPrefix(r.URL.Path, "/repo.git"))
+		if !ok {
+			http.Error(w, "not a smart HTTP request", http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+	}))
+	defer s.Close()
+
+	a := &LsRemoteAuthorizer{Timeout: 10 * time.Second}
+	tests := []struct {
+		cloneURL string
+		creds    *Credentials
+		want     bool
+		wantErr  bool
+	}{
+		{s.URL + "/repo.git", &Credentials{Username: "alice", Password: "pw"}, true, false},
+		{s.URL + "/repo.git", &Credentials{Token: "tok"}, true, false},
+		{s.URL + "/repo.git", &Credentials{Username: "alice", Password: "wrong"}, false, false},
+		{s.URL + "/repo.git", nil, false, false},
+		{s.URL + "/nonexistent.git", &Credentials{Username: "alice", Password: "pw"}, false, false},
+		{"git://example.com/repo.git", nil, true, false},
+		{"ssh://example.com/repo.git", &Credentials{Username: "alice", Password: "pw"}, false, false},
+		{s.URL + "/forbidden.git", &Credentials{Username: "alice", Password: "pw"}, false, false},
+
+		// Upstream failures are errors (which aren't cached), not denials.
+		{s.URL + "/unavailable.git", &Credentials{Username: "alice", Password: "pw"}, false, true},
+	}
+	for _, test := range tests {
+		allowed, err := a.Authorize(context.Background(), &AuthorizationRequest{VCS: "git", CloneURL: test.cloneURL, Credentials: test.creds})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s %+v: got error %v, want error %v", test.cloneURL, test.creds, err, test.wantErr)
+			continue
+		}
+		if allowed != test.want {
+			t.Errorf("%s %+v: got allowed %v, want %v", test.cloneURL, test.creds, allowed, test.want)
+		}
+	}
+}
+
+// authorizerFunc is an Authorizer implemented by a function.
+type authorizerFunc func(*AuthorizationRequest) bool
+
+func (f authorizerFunc) Authorize(ctx context.Context, req *AuthorizationRequest) (bool, error) {
+	return f(req), nil
+}
+
+func TestCachedAuthorizer(t *testing.T) {
+	calls := 0
+	a := &CachedAuthorizer{
+		Authorizer: authorizerFunc(func(req *AuthorizationRequest) bool {
+			calls++
+			return req.Identity.User == "alice"
+		}),
+		TTL: time.Minute,
+	}
+	for i := 0; i < 3; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			allowed, err := a.Authorize(context.Background(), &AuthorizationRequest{Identity: &Identity{User: user}, VCS: "git", CloneURL: "https://example.com/a.git"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := user == "alice"; allowed != want {
+				t.Errorf("%s: got allowed %v, want %v", user, allowed, want)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2 (decisions should be cached)", calls)
+	}
+}
+
+func TestHandler_Authorizer(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	makeGitRepo(t, hostDir)
+
+	h := New(nil)
+	defer h.Close()
+	h.Authorizer = authorizerFunc(func(req *AuthorizationRequest) bool {
+		return req.CloneURL == "https://example.com/repo.git" && req.Credentials != nil && req.Credentials.Username == "alice"
+	})
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+	})
+
+	tests := []struct {
+		username string
+		wantCode int
+	}{
+		{"", http.StatusUnauthorized},
+		{"bob", http.StatusForbidden},
+		{"alice", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil)
+		if test.username != "" {
+			req.SetBasicAuth(test.username, "pw")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.wantCode {
+			t.Errorf("%q: got %d, want %d: %s", test.username, rr.Code, test.wantCode, rr.Body)
+		}
+	}
+}
+
+func TestHandler_AuthorizerIssuedCredentials(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	h := New(nil)
+	defer h.Close()
+	h.Authenticator = &StaticAuthenticator{Tokens: map[string]*Identity{
+		"tok": {User: "alice", Scopes: []Scope{ScopeBlame}},
+	}}
+	var got *AuthorizationRequest
+	h.Authorizer = authorizerFunc(func(req *AuthorizationRequest) bool {
+		got = req
+		return false
+	})
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+	})
+
+	// vcsserver's own tokens are never passed to the Authorizer (which
+	// might send them upstream).
+	req := httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403: %s", rr.Code, rr.Body)
+	}
+	if got == nil || got.Identity == nil || got.Identity.User != "alice" || got.Credentials != nil {
+		t.Errorf("got authorization request %+v, want alice without credentials", got)
+	}
+}
@@ -2,7 +2,6 @@ package vcsserver
 
 import (
 	"github.com/sourcegraph/go-vcs"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -25,9 +24,19 @@ func batchFile(w http.ResponseWriter, r *http.Request, vcs vcs.VCS, dir string,
 		return &httpError{"no files specified", http.StatusBadRequest}
 	}
 
+	if herr := checkRev(rev); herr != nil {
+		return herr
+	}
+	for i, path := range filepaths {
+		var herr *httpError
+		if filepaths[i], herr = cleanFilePath(path); herr != nil {
+			return herr
+		}
+	}
+
 	v, err := vcs.Open(dir)
 	if err != nil {
-		log.Print(err)
+		requestLogger(r).Error("failed to open repository", "err", err)
 		return &httpError{"failed to open repository", http.StatusInternalServerError}
 	}
 
@@ -37,7 +46,7 @@ func batchFile(w http.ResponseWriter, r *http.Request, vcs vcs.VCS, dir string,
 			if os.IsNotExist(err) {
 				continue
 			}
-			log.Print(err)
+			requestLogger(r).Error("failed to read file at revision", "err", err)
 			return &httpError{"failed to read file at revision", http.StatusInternalServerError}
 		}
 		w.Header().Set("X-Batch-File", path)
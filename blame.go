@@ -1,12 +1,14 @@
 package vcsserver
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/sourcegraph/go-blame/blame"
 	"github.com/sourcegraph/go-vcs"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -28,34 +30,84 @@ type Hunk struct {
 type BlameResponse struct {
 	Commits []*Commit
 	Hunks   []*Hunk
+
+	// Skipped is the sorted list of paths of files that were not blamed
+	// because they were ignored.
+	Skipped []string
 }
 
 func enableBlameLog() {
 	blame.Log = log.New(os.Stderr, "blame: ", log.LstdFlags)
 }
 
-func blameRepository(w http.ResponseWriter, r *http.Request, vcs_ vcs.VCS, dir string) *httpError {
+// blameRepository serves the blame of the mirror in dir. repoLock is the
+// mirror's lock, which the caller holds (see streamBlameRepository).
+func blameRepository(w http.ResponseWriter, r *http.Request, conf *Config, vcs_ vcs.VCS, dir string, repoLock sync.Locker) *httpError {
 	v := r.URL.Query().Get("v")
+	if v != "" {
+		if herr := checkRev(v); herr != nil {
+			return herr
+		}
+	}
+	filter, herr := newBlameFilter(r, conf)
+	if herr != nil {
+		return herr
+	}
 
-	var data BlameResponse
-	commits, hunks, err := doBlameRepository(dir, v)
+	_, span := startSpan(r.Context(), "blame")
+	defer span.Finish()
+
+	// Blame results are cached by commit, so resolve v (which may be a
+	// branch name) first.
+	commitID, err := conf.resolveCommit(vcs_, dir, v)
 	if err != nil {
-		log.Print(err)
+		requestLogger(r).Error("failed to blame repository", "err", err)
 		return &httpError{"failed to blame repository", http.StatusInternalServerError}
 	}
-	data.Commits = commits
-	data.Hunks = hunks
+
+	span.SetAttribute("commitID", commitID)
+	if wantsBlameStream(r) {
+		span.SetAttribute("stream", true)
+		return conf.streamBlameRepository(w, r, vcs_, dir, commitID, filter, repoLock)
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = json.NewEncoder(w).Encode(data)
+	cacheFile := conf.blameCacheFile(dir, commitID, filter.cacheKey())
+	ok, err := readBlameCache(w, cacheFile)
+	span.SetAttribute("cached", ok)
+	if ok {
+		if err != nil {
+			requestLogger(r).Error("failed to write response", "err", err)
+			// too late to return an HTTP error
+		}
+		return nil
+	} else if err != nil {
+		requestLogger(r).Warn("failed to read blame cache", "file", cacheFile, "err", err)
+	}
+
+	data, err := conf.filteredBlameRepository(vcs_, dir, commitID, filter)
 	if err != nil {
-		log.Print(err)
+		requestLogger(r).Error("failed to blame repository", "err", err)
+		return &httpError{"failed to blame repository", http.StatusInternalServerError}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(data); err != nil {
+		requestLogger(r).Error("failed to encode blame", "err", err)
+		return &httpError{"failed to encode blame", http.StatusInternalServerError}
+	}
+	if err := writeBlameCache(cacheFile, buf.Bytes()); err != nil {
+		requestLogger(r).Warn("failed to write blame cache", "file", cacheFile, "err", err)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		requestLogger(r).Error("failed to write response", "err", err)
 		// too late to return an HTTP error
 	}
 
 	return nil
 }
 
+// blameIgnores is the default for Config.BlameIgnores.
 var blameIgnores = []string{
 	"node_modules", "bower_components",
 	"doc", "docs", "build", "vendor",
@@ -63,8 +115,46 @@ var blameIgnores = []string{
 	"dist", "assets", "deps/", "dep/",
 }
 
-func doBlameRepository(dir, v string) ([]*Commit, []*Hunk, error) {
-	hunkMap, commitMap, err := blame.BlameRepository(dir, v, blameIgnores)
+// filteredBlameRepository blames the files in the mirror in dir at commitID
+// that are not skipped by filter.
+func (c *Config) filteredBlameRepository(vc vcs.VCS, dir, commitID string, filter *blameFilter) (*BlameResponse, error) {
+	filter.attrs = parseGitattributes(c.gitattributes(vc, dir, commitID))
+	files, err := c.repoFiles(vc, dir, commitID)
+	if err != nil {
+		return nil, err
+	}
+	data := &BlameResponse{Skipped: filter.skipped(files)}
+
+	commits, hunks, err := doBlameRepository(dir, commitID, filter.blameIgnores())
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the hunks of skipped files, and the commits that only they
+	// refer to.
+	skipped := make(map[string]bool, len(data.Skipped))
+	for _, file := range data.Skipped {
+		skipped[file] = true
+	}
+	used := make(map[string]bool)
+	data.Hunks = make([]*Hunk, 0, len(hunks))
+	for _, hunk := range hunks {
+		if !skipped[hunk.File] {
+			data.Hunks = append(data.Hunks, hunk)
+			used[hunk.CommitID] = true
+		}
+	}
+	data.Commits = make([]*Commit, 0, len(used))
+	for _, commit := range commits {
+		if used[commit.CommitID] {
+			data.Commits = append(data.Commits, commit)
+		}
+	}
+	return data, nil
+}
+
+func doBlameRepository(dir, v string, ignores []string) ([]*Commit, []*Hunk, error) {
+	hunkMap, commitMap, err := blame.BlameRepository(dir, v, ignores)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,149 @@
+package vcsserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sourcegraph/go-vcs"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// blameCacheDirName is the name of the directory (underneath the storage
+// directory) that holds cached repository blame results.
+const blameCacheDirName = "blame-cache"
+
+// blameCacheDir returns the directory that holds cached blame results for the
+// mirror in dir, or "" if dir is not underneath the storage directory.
+func (c *Config) blameCacheDir(dir string) string {
+	rel, err := filepath.Rel(c.StorageDir, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.Join(c.StorageDir, blameCacheDirName, rel)
+}
+
+// blameCacheFile returns the file that holds the cached blame result of the
+// mirror in dir at commitID, computed with the list of ignored paths. A
+// commit's blame never changes, so entries only need to be removed when the
+// mirror is evicted.
+func (c *Config) blameCacheFile(dir, commitID string, ignores []string) string {
+	cacheDir := c.blameCacheDir(dir)
+	if cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ignores, "\x00")))
+	return filepath.Join(cacheDir, commitID+"-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// readBlameCache copies the cached blame result in file to w. It returns false
+// if there is no cached result.
+func readBlameCache(w io.Writer, file string) (bool, error) {
+	if file == "" {
+		return false, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return true, err
+}
+
+// writeBlameCache stores the blame result data in file. The file is written
+// atomically, so concurrent readers never see a partial result.
+func writeBlameCache(file string, data []byte) error {
+	if file == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// cachedBlameRepository returns the blame of the mirror in dir at commitID
+// filtered by filter, from the cache if possible. Newly computed results are
+// added to the cache. Cache errors are logged to l.
+func (c *Config) cachedBlameRepository(l *Logger, vc vcs.VCS, dir, commitID string, filter *blameFilter) (*BlameResponse, error) {
+	cacheFile := c.blameCacheFile(dir, commitID, filter.cacheKey())
+	var buf bytes.Buffer
+	if ok, err := readBlameCache(&buf, cacheFile); ok && err == nil {
+		var data BlameResponse
+		if err := json.Unmarshal(buf.Bytes(), &data); err == nil {
+			return &data, nil
+		}
+	}
+
+	data, err := c.filteredBlameRepository(vc, dir, commitID, filter)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := json.Marshal(data); err == nil {
+		if err := writeBlameCache(cacheFile, append(b, '\n')); err != nil {
+			l.Warn("failed to write blame cache", "file", cacheFile, "err", err)
+		}
+	}
+	return data, nil
+}
+
+// evictBlameCache removes all cached blame results for the mirror in dir. It
+// must be called when the mirror is removed or replaced.
+func (c *Config) evictBlameCache(dir string) error {
+	cacheDir := c.blameCacheDir(dir)
+	if cacheDir == "" {
+		return nil
+	}
+	return os.RemoveAll(cacheDir)
+}
+
+// resolveCommit returns the full commit ID that rev refers to in the mirror in
+// dir. If rev is empty, it resolves the default branch's head.
+func (c *Config) resolveCommit(vc vcs.VCS, dir, rev string) (string, error) {
+	var cmd *exec.Cmd
+	switch vc {
+	case vcs.Git:
+		if rev == "" {
+			rev = "HEAD"
+		}
+		cmd = exec.Command(c.GitBinary, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	case vcs.Hg:
+		if rev == "" {
+			rev = "tip"
+		}
+		cmd = exec.Command(c.hgBinary(), "log", "-r", rev, "-l", "1", "--template", "{node}")
+	default:
+		return "", fmt.Errorf("unknown VCS type %q", vc.ShortName())
+	}
+	out, err := runOutput(cmd, dir)
+	if err != nil {
+		return "", err
+	}
+	commitID := strings.TrimSpace(string(out))
+	if !isHex(commitID) || (len(commitID) != 40 && len(commitID) != 64) {
+		return "", fmt.Errorf("%s: bad commit ID %q", strings.Join(cmd.Args, " "), commitID)
+	}
+	return commitID, nil
+}
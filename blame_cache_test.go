@@ -0,0 +1,72 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestBlameCache(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-blamecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := makeGitRepo(t, tmpdir)
+	conf := &Config{StorageDir: tmpdir, GitBinary: GitBinary, BlameIgnores: []string{"vendor"}}
+
+	commitID, err := conf.resolveCommit(vcs.Git, dir, "")
+	if err != nil {
+		t.Fatal("resolveCommit:", err)
+	}
+	if masterID, err := conf.resolveCommit(vcs.Git, dir, "master"); err != nil || masterID != commitID {
+		t.Errorf("want master to resolve to %q, got %q (error: %v)", commitID, masterID, err)
+	}
+	if _, err := conf.resolveCommit(vcs.Git, dir, "doesntexist"); err == nil {
+		t.Error("want error resolving nonexistent revision, got nil")
+	}
+
+	file := conf.blameCacheFile(dir, commitID, (&blameFilter{ignores: conf.BlameIgnores}).cacheKey())
+	if file == "" {
+		t.Fatal("want blame cache file, got none")
+	}
+	if other := conf.blameCacheFile(dir, commitID, nil); other == file {
+		t.Errorf("want blame cache file to depend on ignores, got %q for both", file)
+	}
+	if other := (&Config{StorageDir: "/elsewhere"}).blameCacheFile(dir, commitID, nil); other != "" {
+		t.Errorf("want no blame cache file for mirror outside storage dir, got %q", other)
+	}
+
+	// Requests for any revision that resolves to the same commit are served
+	// from the cache.
+	const cached = `{"Commits":[],"Hunks":[]}` + "\n"
+	if err := writeBlameCache(file, []byte(cached)); err != nil {
+		t.Fatal("writeBlameCache:", err)
+	}
+	for _, url := range []string{"/api/blame", "/api/blame?v=master", "/api/blame?v=" + commitID} {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if herr := blameRepository(w, r, conf, vcs.Git, dir, &testLocker{locked: true}); herr != nil {
+			t.Errorf("%s: blameRepository: %s", url, herr.message)
+			continue
+		}
+		if w.Body.String() != cached {
+			t.Errorf("%s: want cached response %q, got %q", url, cached, w.Body.String())
+		}
+	}
+
+	if err := conf.evictBlameCache(dir); err != nil {
+		t.Fatal("evictBlameCache:", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("want blame cache file removed after eviction, got error %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("want mirror untouched by eviction, got error %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+package vcsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sourcegraph/go-vcs"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LineHunk is a range of consecutive lines in a file that were last changed in
+// the same commit.
+type LineHunk struct {
+	CommitID string
+
+	// StartLine and EndLine are the 1-based line numbers of the first and last
+	// (inclusive) lines of the hunk in the file at the requested revision.
+	StartLine int
+	EndLine   int
+
+	// OrigStartLine is the 1-based line number of the first line of the hunk
+	// in the file at CommitID.
+	OrigStartLine int
+}
+
+// FileBlameResponse is the response to a request to blame a single file. The
+// Message of each commit contains only the first line of the commit message.
+type FileBlameResponse struct {
+	Commits []*Commit
+	Hunks   []*LineHunk
+}
+
+// errBlameNotFound is returned when the revision or file to blame doesn't
+// exist.
+var errBlameNotFound = errors.New("revision or file not found")
+
+// blameFile handles requests of the form /api/blame/<rev>/<path>, optionally
+// with ?start=N&end=M to restrict the blame to lines N through M (inclusive).
+func blameFile(w http.ResponseWriter, r *http.Request, conf *Config, vc vcs.VCS, dir string, extraPath string) *httpError {
+	extraPath = strings.TrimPrefix(extraPath, "/api/blame/")
+	parts := strings.SplitN(extraPath, "/", 2)
+	if len(parts) != 2 {
+		return &httpError{"bad file path", http.StatusNotFound}
+	}
+	rev, path := parts[0], parts[1]
+	if herr := checkRev(rev); herr != nil {
+		return herr
+	}
+	path, herr := cleanFilePath(path)
+	if herr != nil {
+		return herr
+	}
+
+	start, end, herr := parseLineRange(r)
+	if herr != nil {
+		return herr
+	}
+
+	_, span := startSpan(r.Context(), "blameFile")
+	span.SetAttribute("path", path)
+	commits, lines, err := conf.blameFileLines(vc, dir, rev, path, start, end)
+	span.Finish()
+	if err == errBlameNotFound {
+		return &httpError{"not found", http.StatusNotFound}
+	} else if err != nil {
+		requestLogger(r).Error("failed to blame file", "err", err)
+		return &httpError{"failed to blame file", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(&FileBlameResponse{Commits: commits, Hunks: lineHunks(lines)})
+	if err != nil {
+		requestLogger(r).Error("failed to write response", "err", err)
+		// too late to return an HTTP error
+	}
+	return nil
+}
+
+// blameFileLines blames lines start through end (where 0 means the first or
+// last line) of the file at path in the mirror in dir at rev.
+func (c *Config) blameFileLines(vc vcs.VCS, dir, rev, path string, start, end int) ([]*Commit, []*blameLine, error) {
+	switch vc {
+	case vcs.Git:
+		return gitBlameFile(c.GitBinary, dir, rev, path, start, end)
+	case vcs.Hg:
+		return hgBlameFile(c.hgBinary(), dir, rev, path, start, end)
+	}
+	return nil, nil, fmt.Errorf("unknown VCS type %q", vc.ShortName())
+}
+
+// parseLineRange parses the optional start and end query parameters. If
+// absent, start and end are 0, meaning the first and last lines of the file.
+func parseLineRange(r *http.Request) (start, end int, herr *httpError) {
+	q := r.URL.Query()
+	var err error
+	if s := q.Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil || start < 1 {
+			return 0, 0, &httpError{"start must be a positive line number", http.StatusBadRequest}
+		}
+	}
+	if s := q.Get("end"); s != "" {
+		if end, err = strconv.Atoi(s); err != nil || end < 1 || end < start {
+			return 0, 0, &httpError{"end must be a line number not less than start", http.StatusBadRequest}
+		}
+	}
+	return start, end, nil
+}
+
+// blameLine describes the commit that last changed a line.
+type blameLine struct {
+	commitID string
+	line     int // line number at the requested revision
+	origLine int // line number at commitID
+	length   int // length of the line in bytes, including the newline
+}
+
+// lineHunks merges consecutive lines that were last changed in the same commit
+// (and are consecutive in that commit) into hunks.
+func lineHunks(lines []*blameLine) []*LineHunk {
+	hunks := make([]*LineHunk, 0)
+	var prev *blameLine
+	for _, l := range lines {
+		if prev != nil && l.commitID == prev.commitID && l.line == prev.line+1 && l.origLine == prev.origLine+1 {
+			hunks[len(hunks)-1].EndLine = l.line
+		} else {
+			hunks = append(hunks, &LineHunk{CommitID: l.commitID, StartLine: l.line, EndLine: l.line, OrigStartLine: l.origLine})
+		}
+		prev = l
+	}
+	return hunks
+}
+
+func gitBlameFile(gitBinary, dir, rev, path string, start, end int) ([]*Commit, []*blameLine, error) {
+	args := []string{"blame", "--porcelain"}
+	if start != 0 || end != 0 {
+		args = append(args, "-L", lineRangeArg(start, end))
+	}
+	cmd := exec.Command(gitBinary, append(args, rev, "--", path)...)
+	cmd.Dir = dir
+	// The error messages that mean "not found" are only recognized in
+	// English.
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := stderr.String(); strings.Contains(msg, "no such path") || strings.Contains(msg, "bad revision") || strings.Contains(msg, "has only") {
+			return nil, nil, errBlameNotFound
+		}
+		return nil, nil, fmt.Errorf("%s: %s (stderr: %q)", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+	}
+	return parseGitBlamePorcelain(out)
+}
+
+// lineRangeArg returns the argument to git blame's -L option for the line
+// range start through end (where 0 means the first or last line).
+func lineRangeArg(start, end int) string {
+	if start == 0 {
+		start = 1
+	}
+	if end == 0 {
+		return strconv.Itoa(start) + ","
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(end)
+}
+
+// parseGitBlamePorcelain parses the output of git blame --porcelain.
+func parseGitBlamePorcelain(out []byte) ([]*Commit, []*blameLine, error) {
+	commitMap := make(map[string]*Commit)
+	commits := make([]*Commit, 0)
+	var lines []*blameLine
+	var cur *Commit
+	var authorTime int64
+
+	// Lines are read with ReadString, not a bufio.Scanner, because source
+	// lines (e.g., in minified or generated files) can be arbitrarily long.
+	rd := bufio.NewReader(bytes.NewReader(out))
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if strings.HasPrefix(line, "\t") {
+			// Line content (the tab takes the place of the newline).
+			if len(lines) > 0 {
+				lines[len(lines)-1].length = len(line)
+			}
+			continue
+		}
+		key, value := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			key, value = line[:i], line[i+1:]
+		}
+		if (len(key) == 40 || len(key) == 64) && isHex(key) {
+			// "<sha> <orig line> <final line> [<num lines>]", where <sha> is a
+			// SHA-1 or (in SHA-256 repositories) SHA-256 hash.
+			f := strings.Fields(value)
+			if len(f) < 2 {
+				return nil, nil, errors.New("bad git blame header: " + line)
+			}
+			origLine, err1 := strconv.Atoi(f[0])
+			finalLine, err2 := strconv.Atoi(f[1])
+			if err1 != nil || err2 != nil {
+				return nil, nil, errors.New("bad git blame header: " + line)
+			}
+			lines = append(lines, &blameLine{commitID: key, line: finalLine, origLine: origLine})
+			cur = commitMap[key]
+			if cur == nil {
+				cur = &Commit{CommitID: key}
+				commitMap[key] = cur
+				commits = append(commits, cur)
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		switch key {
+		case "author":
+			cur.AuthorName = value
+		case "author-mail":
+			cur.AuthorEmail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "author-time":
+			authorTime, _ = strconv.ParseInt(value, 10, 64)
+		case "author-tz":
+			cur.AuthorDate = gitTime(authorTime, value)
+		case "summary":
+			cur.Message = value
+		}
+	}
+	return commits, lines, nil
+}
+
+// gitTime returns the time t (in seconds since the Unix epoch) in the time
+// zone tz (e.g., "-0700").
+func gitTime(t int64, tz string) time.Time {
+	if len(tz) == 5 {
+		hours, err1 := strconv.Atoi(tz[1:3])
+		minutes, err2 := strconv.Atoi(tz[3:5])
+		if err1 == nil && err2 == nil {
+			offset := hours*3600 + minutes*60
+			if tz[0] == '-' {
+				offset = -offset
+			}
+			return time.Unix(t, 0).In(time.FixedZone(tz, offset))
+		}
+	}
+	return time.Unix(t, 0).UTC()
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func hgBlameFile(hgBinary, dir, rev, path string, start, end int) ([]*Commit, []*blameLine, error) {
+	// Use a "path:" pattern so that path is not interpreted as a glob.
+	cmd := exec.Command(hgBinary, "annotate", "-r", rev, "-c", "-l", "-T", "json", "--", "path:"+path)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "LC_ALL=C", "HGPLAIN=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := stderr.String(); strings.Contains(msg, "no such file") || strings.Contains(msg, "unknown revision") {
+			return nil, nil, errBlameNotFound
+		}
+		return nil, nil, fmt.Errorf("%s: %s (stderr: %q)", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+	}
+
+	var files []struct {
+		Lines []struct {
+			Node   string
+			LineNo int
+			Line   string
+		}
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return nil, nil, err
+	}
+	if len(files) != 1 || start > len(files[0].Lines) {
+		return nil, nil, errBlameNotFound
+	}
+
+	var lines []*blameLine
+	var nodes []string
+	seen := make(map[string]bool)
+	for i, l := range files[0].Lines {
+		line := i + 1
+		if line < start || (end != 0 && line > end) {
+			continue
+		}
+		lines = append(lines, &blameLine{commitID: l.Node, line: line, origLine: l.LineNo, length: len(l.Line)})
+		if !seen[l.Node] {
+			seen[l.Node] = true
+			nodes = append(nodes, l.Node)
+		}
+	}
+	commits, err := hgCommits(hgBinary, dir, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return commits, lines, nil
+}
+
+// hgCommits returns information about the hg changesets with the specified node
+// IDs, in the same order.
+func hgCommits(hgBinary, dir string, nodes []string) ([]*Commit, error) {
+	commits := make([]*Commit, 0, len(nodes))
+	if len(nodes) == 0 {
+		return commits, nil
+	}
+	args := []string{"log", "-T", "json"}
+	for _, node := range nodes {
+		args = append(args, "-r", node)
+	}
+	cmd := exec.Command(hgBinary, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "LC_ALL=C", "HGPLAIN=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s (stderr: %q)", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+	}
+
+	var changesets []struct {
+		Node string
+		User string
+		Date []float64
+		Desc string
+	}
+	if err := json.Unmarshal(out, &changesets); err != nil {
+		return nil, err
+	}
+	for _, cs := range changesets {
+		c := &Commit{CommitID: cs.Node, Message: strings.SplitN(cs.Desc, "\n", 2)[0]}
+		c.AuthorName, c.AuthorEmail = splitHgUser(cs.User)
+		if len(cs.Date) == 2 {
+			// hg's time zone offset is in seconds west of UTC.
+			c.AuthorDate = time.Unix(int64(cs.Date[0]), 0).In(time.FixedZone("", -int(cs.Date[1])))
+		}
+		commits = append(commits, c)
+	}
+	return commits, nil
+}
+
+// splitHgUser splits an hg user string of the form "Name <email>" into the name
+// and email.
+func splitHgUser(user string) (name, email string) {
+	i := strings.Index(user, "<")
+	j := strings.LastIndex(user, ">")
+	if i == -1 || j < i {
+		return user, ""
+	}
+	return strings.TrimSpace(user[:i]), user[i+1 : j]
+}
@@ -0,0 +1,146 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestBlameFile_Git(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-blamefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := makeGitRepo(t, tmpdir)
+	conf := &Config{GitBinary: GitBinary}
+
+	tests := []struct {
+		url         string
+		statusCode  int
+		wantMessage string
+	}{
+		{url: "/api/blame/master/foo", wantMessage: "update"},
+		{url: "/api/blame/master~1/foo", wantMessage: "init"},
+		{url: "/api/blame/master/foo?start=1&end=1", wantMessage: "update"},
+		{url: "/api/blame/master/foo?start=2", statusCode: http.StatusNotFound},
+		{url: "/api/blame/master/foo?start=2&end=1", statusCode: http.StatusBadRequest},
+		{url: "/api/blame/master/doesntexist", statusCode: http.StatusNotFound},
+		{url: "/api/blame/doesntexist/foo", statusCode: http.StatusNotFound},
+		{url: "/api/blame/--output=x/foo", statusCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if test.statusCode == 0 {
+			test.statusCode = http.StatusOK
+		}
+		r, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if herr := blameFile(w, r, conf, vcs.Git, dir, r.URL.Path); herr != nil {
+			w.Code = herr.statusCode
+		}
+		if w.Code != test.statusCode {
+			t.Errorf("%s: want statusCode == %d, got %d", test.url, test.statusCode, w.Code)
+			continue
+		}
+		if test.statusCode != http.StatusOK {
+			continue
+		}
+
+		var resp FileBlameResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: Unmarshal: %s", test.url, err)
+			continue
+		}
+		if len(resp.Commits) != 1 || len(resp.Hunks) != 1 {
+			t.Errorf("%s: want 1 commit and 1 hunk, got %d and %d", test.url, len(resp.Commits), len(resp.Hunks))
+			continue
+		}
+		if c := resp.Commits[0]; c.Message != test.wantMessage || c.AuthorEmail != "a@example.com" {
+			t.Errorf("%s: want commit %q by a@example.com, got %+v", test.url, test.wantMessage, c)
+		}
+		if want := (LineHunk{CommitID: resp.Commits[0].CommitID, StartLine: 1, EndLine: 1, OrigStartLine: 1}); *resp.Hunks[0] != want {
+			t.Errorf("%s: want hunk %+v, got %+v", test.url, want, resp.Hunks[0])
+		}
+	}
+}
+
+func TestParseGitBlamePorcelain(t *testing.T) {
+	const (
+		a = "1111111111111111111111111111111111111111"
+		b = "2222222222222222222222222222222222222222222222222222222222222222" // SHA-256
+	)
+	// Line 3 is longer than bufio.Scanner's maximum token size.
+	line3 := strings.Repeat("x", 2<<20)
+	out := a + ` 1 1 2
+author Alice
+author-mail <alice@example.com>
+author-time 1400000000
+author-tz -0700
+summary first
+filename foo
+	line 1
+` + a + ` 2 2
+	line 2
+` + b + ` 1 3 1
+author Bob
+author-mail <bob@example.com>
+author-time 1400000100
+author-tz +0000
+summary second
+filename foo
+	` + line3 + `
+` + a + ` 4 4 1
+	line 4
+`
+	commits, lines, err := parseGitBlamePorcelain([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantCommits := []*Commit{
+		{CommitID: a, AuthorName: "Alice", AuthorEmail: "alice@example.com", AuthorDate: time.Unix(1400000000, 0).In(time.FixedZone("-0700", -7*3600)), Message: "first"},
+		{CommitID: b, AuthorName: "Bob", AuthorEmail: "bob@example.com", AuthorDate: time.Unix(1400000100, 0).In(time.FixedZone("+0000", 0)), Message: "second"},
+	}
+	if !reflect.DeepEqual(commits, wantCommits) {
+		t.Errorf("want commits %+v, got %+v", wantCommits, commits)
+	}
+
+	wantHunks := []*LineHunk{
+		{CommitID: a, StartLine: 1, EndLine: 2, OrigStartLine: 1},
+		{CommitID: b, StartLine: 3, EndLine: 3, OrigStartLine: 1},
+		{CommitID: a, StartLine: 4, EndLine: 4, OrigStartLine: 4},
+	}
+	if hunks := lineHunks(lines); !reflect.DeepEqual(hunks, wantHunks) {
+		t.Errorf("want hunks %+v, got %+v", wantHunks, hunks)
+	}
+	if want := len(line3) + 1; len(lines) != 4 || lines[2].length != want {
+		t.Errorf("want line 3 length %d, got lines %+v", want, lines)
+	}
+}
+
+func TestSplitHgUser(t *testing.T) {
+	tests := []struct {
+		user, wantName, wantEmail string
+	}{
+		{"Alice <alice@example.com>", "Alice", "alice@example.com"},
+		{"alice", "alice", ""},
+	}
+	for _, test := range tests {
+		name, email := splitHgUser(test.user)
+		if name != test.wantName || email != test.wantEmail {
+			t.Errorf("%q: want (%q, %q), got (%q, %q)", test.user, test.wantName, test.wantEmail, name, email)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package vcsserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/sourcegraph/go-vcs"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// blameFilter determines which files in a repository are blamed.
+//
+// A file is skipped if its path contains any of ignores (Config.BlameIgnores),
+// matches any of the ignoreGlobs given in the request, or is marked
+// linguist-generated or linguist-vendored in the repository's .gitattributes,
+// unless it matches any of the includeGlobs given in the request (which take
+// precedence over all of the others).
+type blameFilter struct {
+	ignores      []string
+	ignoreGlobs  []string
+	includeGlobs []string
+	attrs        []gitattrRule
+}
+
+// newBlameFilter returns a blameFilter for the ignore and include glob
+// patterns in the request's query. Each may be given multiple times or as a
+// comma-separated list.
+func newBlameFilter(r *http.Request, conf *Config) (*blameFilter, *httpError) {
+	q := r.URL.Query()
+	f := &blameFilter{
+		ignores:      conf.BlameIgnores,
+		ignoreGlobs:  splitPatterns(q["ignore"]),
+		includeGlobs: splitPatterns(q["include"]),
+	}
+	for _, pattern := range append(f.ignoreGlobs, f.includeGlobs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, &httpError{fmt.Sprintf("bad glob pattern %q", pattern), http.StatusBadRequest}
+		}
+	}
+	return f, nil
+}
+
+func splitPatterns(values []string) []string {
+	var patterns []string
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
+// cacheKey returns the settings of f that determine the blame result (in
+// addition to the commit, which determines attrs).
+func (f *blameFilter) cacheKey() []string {
+	key := append([]string{"ignores"}, f.ignores...)
+	key = append(key, "ignore")
+	key = append(key, f.ignoreGlobs...)
+	key = append(key, "include")
+	return append(key, f.includeGlobs...)
+}
+
+// blameIgnores returns the substrings that the blame library should use to
+// skip files. It can't skip files that might be included by includeGlobs.
+func (f *blameFilter) blameIgnores() []string {
+	if len(f.includeGlobs) > 0 {
+		return nil
+	}
+	return f.ignores
+}
+
+// skip returns true if the file at path p should not be blamed.
+func (f *blameFilter) skip(p string) bool {
+	if matchAnyGlob(f.includeGlobs, p) {
+		return false
+	}
+	for _, ignore := range f.ignores {
+		if strings.Contains(p, ignore) {
+			return true
+		}
+	}
+	if matchAnyGlob(f.ignoreGlobs, p) {
+		return true
+	}
+	return f.attrSet(p, "linguist-generated") || f.attrSet(p, "linguist-vendored")
+}
+
+// attrSet returns true if the .gitattributes attribute attr is set for the
+// file at path p. The last matching line takes precedence.
+func (f *blameFilter) attrSet(p, attr string) bool {
+	for i := len(f.attrs) - 1; i >= 0; i-- {
+		if rule := f.attrs[i]; rule.attr == attr && rule.match(p) {
+			return rule.set
+		}
+	}
+	return false
+}
+
+// skipped returns the paths in files that should not be blamed, sorted.
+func (f *blameFilter) skipped(files []string) []string {
+	skipped := make([]string, 0)
+	for _, file := range files {
+		if f.skip(file) {
+			skipped = append(skipped, file)
+		}
+	}
+	sort.Strings(skipped)
+	return skipped
+}
+
+func matchAnyGlob(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns true if the glob pattern matches the file path p or one of
+// its parent directories. A pattern without a slash may also match any single
+// path component (e.g., "*.min.js" matches "a/b.min.js"), as in .gitignore.
+func matchGlob(pattern, p string) bool {
+	return matchPathGlob(pattern, p, !strings.Contains(pattern, "/"))
+}
+
+// matchPathGlob is like matchGlob, but pattern may only match a single path
+// component if anywhere is true.
+func matchPathGlob(pattern, p string, anywhere bool) bool {
+	components := strings.Split(p, "/")
+	for i := range components {
+		if ok, _ := path.Match(pattern, strings.Join(components[:i+1], "/")); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, components[i]); ok && anywhere {
+			return true
+		}
+	}
+	return false
+}
+
+// gitattrRule is a line of a .gitattributes file that sets or unsets the
+// linguist-generated or linguist-vendored attribute.
+type gitattrRule struct {
+	pattern  string
+	anchored bool   // whether pattern only matches relative to the root
+	attr     string // "linguist-generated" or "linguist-vendored"
+	set      bool
+}
+
+// match returns true if r's pattern matches the file path p. As in git,
+// patterns only match files (not the contents of matching directories),
+// unanchored patterns match the file name in any directory, and "**"
+// components match any number of directories.
+func (r gitattrRule) match(p string) bool {
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(p))
+		return ok
+	}
+	return matchGlobComponents(strings.Split(r.pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchGlobComponents(pattern, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			// A trailing "/**" matches everything inside a directory.
+			return len(components) > 0
+		}
+		for i := range components {
+			if matchGlobComponents(pattern[1:], components[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], components[0]); !ok {
+		return false
+	}
+	return matchGlobComponents(pattern[1:], components[1:])
+}
+
+// parseGitattributes returns the rules in the .gitattributes file data that
+// set (e.g., "linguist-generated" or "linguist-vendored=true") or unset
+// (e.g., "-linguist-vendored" or "linguist-vendored=false") the
+// linguist-generated or linguist-vendored attributes.
+func parseGitattributes(data []byte) []gitattrRule {
+	var rules []gitattrRule
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// Patterns with a trailing slash only match directories, which
+		// have no attributes in git.
+		pattern := fields[0]
+		if strings.HasSuffix(pattern, "/") {
+			continue
+		}
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			continue
+		}
+		for _, attr := range fields[1:] {
+			name, value := attr, "true"
+			if i := strings.Index(attr, "="); i != -1 {
+				name, value = attr[:i], attr[i+1:]
+			}
+			if strings.HasPrefix(name, "-") || strings.HasPrefix(name, "!") {
+				name, value = name[1:], "false"
+			}
+			if name == "linguist-generated" || name == "linguist-vendored" {
+				rules = append(rules, gitattrRule{pattern: pattern, anchored: anchored, attr: name, set: value != "false"})
+			}
+		}
+	}
+	return rules
+}
+
+// repoFiles returns the paths of all files in the mirror in dir at commitID.
+func (c *Config) repoFiles(vc vcs.VCS, dir, commitID string) ([]string, error) {
+	var cmd *exec.Cmd
+	switch vc {
+	case vcs.Git:
+		cmd = exec.Command(c.GitBinary, "ls-tree", "-r", "-z", "--name-only", commitID)
+	case vcs.Hg:
+		cmd = exec.Command(c.hgBinary(), "files", "-r", commitID, "-0")
+	default:
+		return nil, fmt.Errorf("unknown VCS type %q", vc.ShortName())
+	}
+	out, err := runOutput(cmd, dir)
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(string(out), func(r rune) bool { return r == 0 }), nil
+}
+
+// gitattributes returns the contents of the .gitattributes file at the root
+// of the mirror in dir at commitID, or nil if there is none.
+func (c *Config) gitattributes(vc vcs.VCS, dir, commitID string) []byte {
+	var cmd *exec.Cmd
+	switch vc {
+	case vcs.Git:
+		cmd = exec.Command(c.GitBinary, "show", commitID+":.gitattributes")
+	case vcs.Hg:
+		cmd = exec.Command(c.hgBinary(), "cat", "-r", commitID, "--", "path:.gitattributes")
+	default:
+		return nil
+	}
+	out, err := runOutput(cmd, dir)
+	if err != nil {
+		// Most repositories have no .gitattributes.
+		return nil
+	}
+	return out
+}
+
+// runOutput runs cmd in dir and returns its standard output, or an error that
+// includes its standard error.
+func runOutput(cmd *exec.Cmd, dir string) ([]byte, error) {
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s (stderr: %q)", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+	}
+	return out, nil
+}
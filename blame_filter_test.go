@@ -0,0 +1,124 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestBlameFilter(t *testing.T) {
+	conf := &Config{BlameIgnores: []string{"node_modules", ".min.js"}}
+	tests := []struct {
+		query string
+		attrs string
+		skip  []string
+		blame []string
+	}{
+		{
+			skip:  []string{"node_modules/a.js", "a/b.min.js"},
+			blame: []string{"a.js", "lib/vendor/a.js"},
+		},
+		{
+			query: "ignore=vendor&ignore=*.pb.go,docs/*",
+			skip:  []string{"vendor/a.go", "lib/vendor/a.go", "x/y.pb.go", "docs/a.md", "docs/sub/a.md"},
+			blame: []string{"a.go", "vendors/a.go", "lib/docs/a.md"},
+		},
+		{
+			query: "include=node_modules/mylib",
+			skip:  []string{"node_modules/other/a.js"},
+			blame: []string{"node_modules/mylib/a.js", "a.js"},
+		},
+		{
+			query: "ignore=*&include=src",
+			skip:  []string{"a.go", "lib/a.go"},
+			blame: []string{"src/a.go", "src/sub/a.go"},
+		},
+		{
+			attrs: "# comment\n*.gen.go linguist-generated\n/third_party/** linguist-vendored=true\nthird_party/ours/** -linguist-vendored\n",
+			skip:  []string{"a.gen.go", "x/a.gen.go", "third_party/a.c"},
+			blame: []string{"a.go", "third_party/ours/a.c", "x/third_party/a.c"},
+		},
+		{
+			// Unsetting one attribute doesn't unset the other.
+			attrs: "gen/** linguist-generated\ngen/** linguist-vendored\ngen/keep/** -linguist-vendored\n",
+			skip:  []string{"gen/a.go", "gen/keep/a.go"},
+		},
+		{
+			// Patterns that match a directory don't match its contents.
+			attrs: "vendor linguist-vendored\ndocs/api linguist-generated\n**/testdata/** linguist-generated\nlib/**/*.js linguist-vendored\nbuild/ linguist-generated\n",
+			skip:  []string{"vendor", "x/vendor", "docs/api", "testdata/a", "x/testdata/y/a", "lib/a.js", "lib/x/y/a.js"},
+			blame: []string{"vendor/a.go", "x/vendor/a.go", "docs/api/a.md", "x/docs/api", "testdata", "lib/a.go", "build/a.go"},
+		},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/api/blame?"+test.query, nil)
+		f, herr := newBlameFilter(r, conf)
+		if herr != nil {
+			t.Errorf("%q: newBlameFilter: %s", test.query, herr.message)
+			continue
+		}
+		f.attrs = parseGitattributes([]byte(test.attrs))
+		for _, p := range test.skip {
+			if !f.skip(p) {
+				t.Errorf("%q %q: want %q skipped", test.query, test.attrs, p)
+			}
+		}
+		for _, p := range test.blame {
+			if f.skip(p) {
+				t.Errorf("%q %q: want %q blamed", test.query, test.attrs, p)
+			}
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/api/blame?ignore=[", nil)
+	if _, herr := newBlameFilter(r, conf); herr == nil || herr.statusCode != http.StatusBadRequest {
+		t.Errorf("want bad glob pattern error, got %v", herr)
+	}
+}
+
+func TestFilteredBlameRepository_Skipped(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-blamefilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cmd := exec.Command("sh", "-c", `
+set -e
+git init -q work
+cd work
+mkdir -p src gen node_modules/x
+echo a > src/a.go
+echo b > gen/b.go
+echo c > node_modules/x/c.js
+echo 'gen/** linguist-generated' > .gitattributes
+git add .
+git -c user.name=a -c user.email=a@example.com commit -q -m init
+cd ..
+git clone -q --bare work repo.git
+`)
+	cmd.Dir = tmpdir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("creating git repo: %s (output: %s)", err, out)
+	}
+	dir := filepath.Join(tmpdir, "repo.git")
+	conf := &Config{StorageDir: tmpdir, GitBinary: GitBinary, BlameIgnores: []string{"node_modules"}}
+
+	commitID, err := conf.resolveCommit(vcs.Git, dir, "")
+	if err != nil {
+		t.Fatal("resolveCommit:", err)
+	}
+	data, err := conf.filteredBlameRepository(vcs.Git, dir, commitID, &blameFilter{ignores: conf.BlameIgnores})
+	if err != nil {
+		t.Fatal("filteredBlameRepository:", err)
+	}
+	if want := []string{"gen/b.go", "node_modules/x/c.js"}; !reflect.DeepEqual(data.Skipped, want) {
+		t.Errorf("want skipped %q, got %q", want, data.Skipped)
+	}
+}
@@ -0,0 +1,191 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sourcegraph/go-vcs"
+	"mime"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ndjsonContentType is the content type of newline-delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// BlameEvent is a line of a streaming (NDJSON) repository blame response.
+// Each event sets exactly one of Commit, File (along with Hunks), Skipped,
+// Failed or Error.
+//
+// The first event lists the Skipped files. Each commit is sent (as a Commit
+// event) before the first hunk that refers to it, and the hunks of each file
+// are sent together (as a File event with Hunks). A file that can't be blamed
+// is sent as a Failed event, and the stream continues with the next file. If
+// the whole blame fails partway through, the last event is an Error.
+type BlameEvent struct {
+	Commit  *Commit  `json:",omitempty"`
+	File    string   `json:",omitempty"`
+	Hunks   []*Hunk  `json:",omitempty"`
+	Skipped []string `json:",omitempty"`
+	Failed  string   `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// wantsBlameStream returns true if the client requested a streaming blame
+// response, with ?format=ndjson or by accepting only application/x-ndjson.
+func wantsBlameStream(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	return mediaType == ndjsonContentType
+}
+
+// streamBlameRepository writes the blame of the files in the mirror in dir at
+// commitID that are not skipped by filter as a stream of BlameEvents. Files
+// are blamed one at a time, so memory use is bounded by the size of the
+// largest file rather than of the repository. Unlike the non-streaming
+// response, commit messages only contain their first line.
+//
+// repoLock (the mirror's lock, which the caller holds) is released while each
+// event is written, so that a slow client doesn't block updates of the mirror
+// for the whole response. Updates don't change the files at commitID, but if
+// the mirror is deleted or recloned meanwhile, the stream ends with an Error.
+func (c *Config) streamBlameRepository(w http.ResponseWriter, r *http.Request, vc vcs.VCS, dir, commitID string, filter *blameFilter, repoLock sync.Locker) *httpError {
+	filter.attrs = parseGitattributes(c.gitattributes(vc, dir, commitID))
+	files, err := c.repoFiles(vc, dir, commitID)
+	if err != nil {
+		requestLogger(r).Error("failed to blame repository", "err", err)
+		return &httpError{"failed to blame repository", http.StatusInternalServerError}
+	}
+	sizes, err := c.repoFileSizes(vc, dir, commitID)
+	if err != nil {
+		requestLogger(r).Error("failed to blame repository", "err", err)
+		return &httpError{"failed to blame repository", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType+"; charset=utf-8")
+	enc := json.NewEncoder(w)
+	send := func(ev *BlameEvent) error {
+		repoLock.Unlock()
+		defer repoLock.Lock()
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	skipped := filter.skipped(files)
+	if err := send(&BlameEvent{Skipped: skipped}); err != nil {
+		requestLogger(r).Error("failed to write response", "err", err)
+		return nil
+	}
+	skip := make(map[string]bool, len(skipped))
+	for _, file := range skipped {
+		skip[file] = true
+	}
+
+	sent := make(map[string]bool)
+	for _, file := range files {
+		if skip[file] {
+			continue
+		}
+		commits, lines, err := c.blameFileLines(vc, dir, commitID, file, 0, 0)
+		if err == errBlameNotFound {
+			// The path is not a regular file (e.g., a submodule).
+			continue
+		} else if err != nil {
+			if !isMirrorDir(vc.ShortName(), dir) {
+				// The mirror was deleted (or is being recloned) while the
+				// lock was released, so the remaining files would fail too.
+				requestLogger(r).Error("failed to blame repository", "file", file, "err", err)
+				// too late to return an HTTP error
+				send(&BlameEvent{Error: "failed to blame repository"})
+				return nil
+			}
+			requestLogger(r).Warn("failed to blame file", "file", file, "err", err)
+			if err := send(&BlameEvent{Failed: file}); err != nil {
+				requestLogger(r).Error("failed to write response", "err", err)
+				return nil
+			}
+			continue
+		}
+		for _, commit := range commits {
+			if !sent[commit.CommitID] {
+				sent[commit.CommitID] = true
+				if err := send(&BlameEvent{Commit: commit}); err != nil {
+					requestLogger(r).Error("failed to write response", "err", err)
+					return nil
+				}
+			}
+		}
+		size, ok := sizes[file]
+		if !ok {
+			size = -1
+		}
+		if hunks := charHunks(file, lines, size); len(hunks) > 0 {
+			if err := send(&BlameEvent{File: file, Hunks: hunks}); err != nil {
+				requestLogger(r).Error("failed to write response", "err", err)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// charHunks merges the consecutive lines of file that were last changed in the
+// same commit into hunks whose Start and End are byte offsets in the file. If
+// size (the file's size in bytes) is not negative, the last hunk ends at size,
+// since git blame doesn't say whether the last line ends in a newline.
+func charHunks(file string, lines []*blameLine, size int64) []*Hunk {
+	var hunks []*Hunk
+	offset := 0
+	for i, l := range lines {
+		if i > 0 && l.commitID == lines[i-1].commitID {
+			hunks[len(hunks)-1].End += l.length
+		} else {
+			hunks = append(hunks, &Hunk{CommitID: l.commitID, File: file, Start: offset, End: offset + l.length})
+		}
+		offset += l.length
+	}
+	if len(hunks) > 0 && size >= 0 && int64(offset) > size {
+		hunks[len(hunks)-1].End = int(size)
+	}
+	return hunks
+}
+
+// repoFileSizes returns the sizes in bytes of the files in the mirror in dir
+// at commitID, if the lengths of blamed lines don't already account for them.
+// hg annotate reports lines with their actual newlines, so it returns nil for
+// hg.
+func (c *Config) repoFileSizes(vc vcs.VCS, dir, commitID string) (map[string]int64, error) {
+	if vc != vcs.Git {
+		return nil, nil
+	}
+	out, err := runOutput(exec.Command(c.GitBinary, "ls-tree", "-r", "-l", "-z", commitID), dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, entry := range strings.FieldsFunc(string(out), func(r rune) bool { return r == 0 }) {
+		// "<mode> <type> <object> <size>\t<path>", where size is "-" for
+		// submodules.
+		tab := strings.Index(entry, "\t")
+		if tab == -1 {
+			return nil, fmt.Errorf("bad git ls-tree entry %q", entry)
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("bad git ls-tree entry %q", entry)
+		}
+		if size, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			sizes[entry[tab+1:]] = size
+		}
+	}
+	return sizes, nil
+}
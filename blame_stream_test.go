@@ -0,0 +1,149 @@
+package vcsserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestBlameRepository_Stream(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-blamestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cmd := exec.Command("sh", "-c", `
+set -e
+git init -q work
+cd work
+printf 'a\nb\n' > a.txt
+mkdir vendor
+echo v > vendor/v.txt
+git add .
+git -c user.name=a -c user.email=a@example.com commit -q -m first
+printf 'a\nb\nc\n' > a.txt
+printf d > d.txt
+git add .
+git -c user.name=b -c user.email=b@example.com commit -q -m second
+cd ..
+git clone -q --bare work repo.git
+`)
+	cmd.Dir = tmpdir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("creating git repo: %s (output: %s)", err, out)
+	}
+	dir := filepath.Join(tmpdir, "repo.git")
+	conf := &Config{StorageDir: tmpdir, GitBinary: GitBinary, BlameIgnores: []string{"vendor"}}
+
+	for _, header := range []string{"", ndjsonContentType} {
+		url := "/api/blame?v=master"
+		if header == "" {
+			url += "&format=ndjson"
+		}
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Set("Accept", header)
+		w := httptest.NewRecorder()
+		repoLock := &testLocker{locked: true}
+		if herr := blameRepository(w, r, conf, vcs.Git, dir, repoLock); herr != nil {
+			t.Fatalf("%s: blameRepository: %s", url, herr.message)
+		}
+		if !repoLock.locked || repoLock.unlocks == 0 {
+			t.Errorf("%s: want repo lock released while writing and held on return, got %+v", url, repoLock)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ndjsonContentType+"; charset=utf-8" {
+			t.Errorf("%s: want NDJSON content type, got %q", url, ct)
+		}
+
+		var events []*BlameEvent
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			var ev BlameEvent
+			if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+				t.Fatalf("%s: Unmarshal %q: %s", url, s.Text(), err)
+			}
+			events = append(events, &ev)
+		}
+		if len(events) != 5 {
+			t.Fatalf("%s: want 5 events, got %d", url, len(events))
+		}
+
+		if want := []string{"vendor/v.txt"}; !reflect.DeepEqual(events[0].Skipped, want) {
+			t.Errorf("%s: want first event to skip %q, got %+v", url, want, events[0])
+		}
+		first, second := events[1].Commit, events[2].Commit
+		if first == nil || second == nil || first.Message != "first" || second.Message != "second" {
+			t.Fatalf("%s: want commits first and second, got %+v and %+v", url, events[1], events[2])
+		}
+		wantA := &BlameEvent{File: "a.txt", Hunks: []*Hunk{
+			{CommitID: first.CommitID, File: "a.txt", Start: 0, End: 4},
+			{CommitID: second.CommitID, File: "a.txt", Start: 4, End: 6},
+		}}
+		if !reflect.DeepEqual(events[3], wantA) {
+			t.Errorf("%s: want %+v, got %+v", url, wantA, events[3])
+		}
+		// d.txt has no trailing newline.
+		wantD := &BlameEvent{File: "d.txt", Hunks: []*Hunk{{CommitID: second.CommitID, File: "d.txt", Start: 0, End: 1}}}
+		if !reflect.DeepEqual(events[4], wantD) {
+			t.Errorf("%s: want %+v, got %+v", url, wantD, events[4])
+		}
+	}
+
+	// A file that can't be blamed is reported, and the remaining files are
+	// still blamed.
+	failingGit := filepath.Join(tmpdir, "failing-git")
+	script := "#!/bin/sh\nfor arg; do [ \"$arg\" = a.txt ] && { echo boom >&2; exit 1; }; done\nexec " + GitBinary + " \"$@\"\n"
+	if err := ioutil.WriteFile(failingGit, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf.GitBinary = failingGit
+	r, _ := http.NewRequest("GET", "/api/blame?v=master&format=ndjson", nil)
+	w := httptest.NewRecorder()
+	if herr := blameRepository(w, r, conf, vcs.Git, dir, &testLocker{locked: true}); herr != nil {
+		t.Fatalf("blameRepository: %s", herr.message)
+	}
+	body := w.Body.String()
+	var events []*BlameEvent
+	for dec := json.NewDecoder(strings.NewReader(body)); dec.More(); {
+		var ev BlameEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &ev)
+	}
+	if len(events) != 4 || events[1].Failed != "a.txt" || events[2].Commit == nil || events[3].File != "d.txt" {
+		t.Errorf("want events Skipped, Failed a.txt, Commit and File d.txt, got %d events: %s", len(events), body)
+	}
+}
+
+// testLocker is a sync.Locker that records its use. It panics if it is locked
+// or unlocked twice in a row.
+type testLocker struct {
+	locked  bool
+	unlocks int
+}
+
+func (l *testLocker) Lock() {
+	if l.locked {
+		panic("already locked")
+	}
+	l.locked = true
+}
+
+func (l *testLocker) Unlock() {
+	if !l.locked {
+		panic("not locked")
+	}
+	l.locked = false
+	l.unlocks++
+}
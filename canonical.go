@@ -0,0 +1,92 @@
+package vcsserver
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cleanRepoPath validates the repository path p (taken from the request path)
+// and returns it in clean form, with no leading or trailing slash. Paths that
+// contain ".." components (or a final component, such as "..git", that is "."
+// or ".." without its ".git" suffix), NUL or other control characters,
+// backslashes, invalid UTF-8 or (possibly double-encoded) percent signs are
+// rejected.
+func cleanRepoPath(p string) (string, *httpError) {
+	if err := checkPathChars(p); err != nil {
+		return "", err
+	}
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return "", &httpError{"repo path must not contain ..", http.StatusBadRequest}
+		}
+	}
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return "", &httpError{"empty repo path", http.StatusNotFound}
+	}
+	for _, c := range strings.Split(canonicalRepoPath(p, false), "/") {
+		if c == "." || c == ".." {
+			return "", &httpError{"repo path must not contain . or ..", http.StatusBadRequest}
+		}
+	}
+	return p, nil
+}
+
+// cleanFilePath validates the path p of a file in a repository and returns it
+// in clean form, with no leading or trailing slash. It rejects the same paths
+// as cleanRepoPath.
+func cleanFilePath(p string) (string, *httpError) {
+	if err := checkPathChars(p); err != nil {
+		return "", err
+	}
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return "", &httpError{"file path must not contain ..", http.StatusBadRequest}
+		}
+	}
+	return strings.Trim(path.Clean("/"+p), "/"), nil
+}
+
+// checkRev returns a non-nil *httpError if rev is not a safe revision
+// specifier (e.g., if it could be interpreted as a command-line option).
+func checkRev(rev string) *httpError {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return &httpError{"bad revision", http.StatusBadRequest}
+	}
+	return checkPathChars(rev)
+}
+
+func checkPathChars(p string) *httpError {
+	if !utf8.ValidString(p) {
+		return &httpError{"path must be valid UTF-8", http.StatusBadRequest}
+	}
+	for _, r := range p {
+		if unicode.IsControl(r) || r == '\\' || r == '%' {
+			return &httpError{"path contains invalid characters", http.StatusBadRequest}
+		}
+	}
+	return nil
+}
+
+// canonicalRepoPath returns the canonical form of the clean repository path p,
+// which is the same for all equivalent clone URLs: it has no trailing ".git"
+// and, if caseInsensitive, is lowercase. Equivalent clone URLs share a
+// mirror and are subject to the same access rules.
+func canonicalRepoPath(p string, caseInsensitive bool) string {
+	p = strings.TrimRight(strings.TrimSuffix(p, ".git"), "/")
+	if caseInsensitive {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// caseInsensitiveHosts are the hosts whose repository paths are known to be
+// case insensitive.
+var caseInsensitiveHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
@@ -0,0 +1,166 @@
+package vcsserver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanRepoPath(t *testing.T) {
+	tests := []struct {
+		p       string
+		want    string
+		wantErr bool
+	}{
+		{p: "foo/bar.git", want: "foo/bar.git"},
+		{p: "foo//bar/", want: "foo/bar"},
+		{p: "./foo/./bar", want: "foo/bar"},
+		{p: "foo/../bar", wantErr: true},
+		{p: "..", wantErr: true},
+		{p: "foo/bar\x00", wantErr: true},
+		{p: "foo\\..\\bar", wantErr: true},
+		{p: "foo/%2e%2e/bar", wantErr: true},
+		{p: "foo/\xff", wantErr: true},
+		{p: "", wantErr: true},
+		{p: "/", wantErr: true},
+		{p: "..git", wantErr: true},
+		{p: "...git", wantErr: true},
+		{p: "foo/..git", wantErr: true},
+		{p: "foo/.git/..git", wantErr: true},
+		{p: "foo/.git", want: "foo/.git"},
+	}
+
+	for _, test := range tests {
+		got, err := cleanRepoPath(test.p)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: want err %v, got %v", test.p, test.wantErr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: want %q, got %q", test.p, test.want, got)
+		}
+	}
+}
+
+func TestCanonicalRepoPath(t *testing.T) {
+	tests := []struct {
+		p               string
+		caseInsensitive bool
+		want            string
+	}{
+		{"foo/bar", false, "foo/bar"},
+		{"foo/bar.git", false, "foo/bar"},
+		{"Foo/Bar.git", false, "Foo/Bar"},
+		{"Foo/Bar.git", true, "foo/bar"},
+		{"foo/.git", false, "foo"},
+		{"foo/..git", false, "foo/."},
+		{"..git", false, "."},
+		{"foo/.git/..git", false, "foo/.git/."},
+	}
+
+	for _, test := range tests {
+		if got := canonicalRepoPath(test.p, test.caseInsensitive); got != test.want {
+			t.Errorf("%q (caseInsensitive=%v): want %q, got %q", test.p, test.caseInsensitive, test.want, got)
+		}
+	}
+}
+
+func TestCheckRev(t *testing.T) {
+	for _, rev := range []string{"master", "1234abcdef", "my/branch", "HEAD~1"} {
+		if err := checkRev(rev); err != nil {
+			t.Errorf("%q: want no error, got %v", rev, err)
+		}
+	}
+	for _, rev := range []string{"", "--output=/tmp/x", "-p", "a\x00b"} {
+		if err := checkRev(rev); err == nil {
+			t.Errorf("%q: want error, got nil", rev)
+		}
+	}
+}
+
+func TestRouter_EquivalentCloneURLs(t *testing.T) {
+	access := HostsPolicy([]string{"example.com"})
+	var uris []string
+	for _, path := range []string{
+		"/git/https/example.com/foo/bar.git",
+		"/git/https/example.com/foo/bar/-",
+		"/git/https/example.com/foo/bar/-/",
+		"/git/https/EXAMPLE.com/foo//bar/-",
+		"/2/git/https/example.com/foo/bar.git/info/refs",
+	} {
+		route, err := router(access, path)
+		if err != nil {
+			t.Fatalf("%s: router failed: %s", path, err.message)
+		}
+		uris = append(uris, route.uri)
+	}
+	for _, uri := range uris[1:] {
+		if uri != uris[0] {
+			t.Errorf("want all equivalent clone URLs to have uri %q, got %q", uris[0], uri)
+		}
+	}
+}
+
+func TestRouter_CaseInsensitiveHosts(t *testing.T) {
+	access := HostsPolicy([]string{"example.com", "github.com"})
+	tests := []struct {
+		path1, path2 string
+		wantSame     bool
+	}{
+		{"/git/https/example.com/foo/bar.git", "/git/https/example.com/Foo/Bar.git", false},
+		{"/git/https/github.com/foo/bar.git", "/git/https/github.com/Foo/Bar.git", true},
+		{"/git/https/github.com/foo/bar.git", "/git/https/GitHub.com/FOO/bar/-", true},
+	}
+	for _, test := range tests {
+		route1, err := router(access, test.path1)
+		if err != nil {
+			t.Fatalf("%s: router failed: %s", test.path1, err.message)
+		}
+		route2, err := router(access, test.path2)
+		if err != nil {
+			t.Fatalf("%s: router failed: %s", test.path2, err.message)
+		}
+		if same := route1.uri == route2.uri; same != test.wantSame {
+			t.Errorf("%s and %s: want same uri %v, got uris %q and %q", test.path1, test.path2, test.wantSame, route1.uri, route2.uri)
+		}
+	}
+}
+
+func FuzzRouter(f *testing.F) {
+	for _, path := range []string{
+		"/git/https/example.com/foo/bar.git/info/refs",
+		"/hg/https/example.com/foo/-/v/default/a/b",
+		"/2/git/git/example.com/foo/bar/api/blame",
+		"/git/https/[::1]:8443/foo/../bar.git",
+		"/git/ssh/example.com/./.git/-/v/x",
+		"/git/http/[::1]:8443/..git",
+	} {
+		f.Add(path)
+	}
+
+	conf := &Config{
+		AccessPolicy: AccessPolicy{Hosts: []*HostRule{{Host: "example.com"}, {Host: "[::1]:8443"}}},
+		StorageDir:   "/tmp/vcsserver-fuzz",
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		route, err := router(&conf.AccessPolicy, path)
+		if err != nil {
+			return
+		}
+		if strings.ContainsAny(route.uri, "\x00\\%") {
+			t.Errorf("%q: uri %q contains invalid characters", path, route.uri)
+		}
+		for _, c := range strings.Split(route.uri, "/") {
+			if c == ".." || c == "." || c == "" {
+				t.Errorf("%q: uri %q contains %q component", path, route.uri, c)
+			}
+		}
+		root := filepath.Join(conf.StorageDir, route.vcs.ShortName())
+		if dir := conf.repoDir(route.vcs, route.uri); !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			t.Errorf("%q: repo dir %q is not underneath %q", path, dir, root)
+		}
+		if route.extraPath != "" && !strings.HasPrefix(route.extraPath, "/") {
+			t.Errorf("%q: extraPath %q does not begin with /", path, route.extraPath)
+		}
+	})
+}
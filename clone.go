@@ -1,20 +1,30 @@
 package vcsserver
 
 import (
+	"context"
 	"errors"
 	"github.com/sourcegraph/go-vcs"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-// GitHTTPBackend is the path to the git-http-backend executable.
+// GitHTTPBackend is the path to the git-http-backend executable. It is the
+// default for Config.GitHTTPBackend.
 var GitHTTPBackend = os.Getenv("GIT_HTTP_BACKEND")
 
-// Python27 is the path to Python 2.7.
+// Python27 is the path to Python 2.7. It is the default for Config.Python27.
 var Python27 = os.Getenv("PYTHON27")
 
+// MinUpdateInterval is the default for Config.MinUpdateInterval.
+var MinUpdateInterval time.Duration
+
+// forceUpdateHeader is the request header that forces the mirror to be
+// updated, even if it was updated less than Config.MinUpdateInterval ago.
+const forceUpdateHeader = "X-Vcsserver-Force-Update"
+
 func init() {
 	if GitHTTPBackend == "" {
 		GitHTTPBackend = "/usr/lib/git-core/git-http-backend"
@@ -32,7 +42,9 @@ func (h *Handler) startCloneOrUpdate(dir string) (c chan *httpError, shouldWait
 		h.currentlyUpdating[dir] = make([]chan *httpError, 0)
 		return nil, false
 	}
-	c = make(chan *httpError, 0)
+	// Buffer the channel so that endCloneOrUpdate doesn't block on waiters
+	// that have timed out.
+	c = make(chan *httpError, 1)
 	h.currentlyUpdating[dir] = append(h.currentlyUpdating[dir], c)
 	return c, true
 }
@@ -47,39 +59,87 @@ func (h *Handler) endCloneOrUpdate(dir string, herr *httpError) {
 	delete(h.currentlyUpdating, dir)
 }
 
-func (h *Handler) cloneOrUpdate(vcs vcs.VCS, dir string, cloneURL string, forceUpdate bool) (herr *httpError) {
-	if Offline {
-		log.Printf("Skipping cloneOrUpdate of %s in offline mode", cloneURL)
+// updatedWithin reports whether the mirror at dir was successfully cloned or
+// updated by h less than d ago.
+func (h *Handler) updatedWithin(dir string, d time.Duration) bool {
+	if d <= 0 {
+		return false
+	}
+	s := h.mirrorState(dir)
+	return !s.lastUpdate.IsZero() && time.Since(s.lastUpdate) < d
+}
+
+func (h *Handler) cloneOrUpdate(ctx context.Context, conf *Config, vcs vcs.VCS, dir string, cloneURL string, forceUpdate bool) (herr *httpError) {
+	if conf.Offline {
+		h.contextLogger(ctx).Debug("skipping clone or update in offline mode", "cloneURL", cloneURL)
 		return nil
 	}
 
+	ctx, span := startSpan(ctx, "cloneOrUpdate")
+	span.SetAttribute("cloneURL", cloneURL)
+	span.SetAttribute("forceUpdate", forceUpdate)
+	defer func() {
+		if herr != nil {
+			span.SetError(herr.message)
+		}
+		span.Finish()
+	}()
+
 	c, shouldWait := h.startCloneOrUpdate(dir)
-	if shouldWait {
-		err := <-c
-		if err != nil {
+	// Requests that wait for another request's clone or update spend the
+	// whole span waiting.
+	span.SetAttribute("waited", shouldWait)
+	if !shouldWait {
+		c = make(chan *httpError, 1)
+		go func() {
+			herr := h.doCloneOrUpdate(ctx, conf, vcs, dir, cloneURL, forceUpdate)
+			h.endCloneOrUpdate(dir, herr)
+			c <- herr
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if conf.UpdateTimeout.Duration > 0 {
+		timer := time.NewTimer(conf.UpdateTimeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-c:
+		if err != nil && shouldWait {
 			err = &httpError{message: err.message, statusCode: err.statusCode}
 			err.message = "after waiting: " + err.message
 		}
 		return err
+	case <-timeout:
+		h.contextLogger(ctx).Warn("timed out waiting for clone or update", "cloneURL", cloneURL, "timeout", conf.UpdateTimeout.Duration)
+		return &httpError{"timed out waiting for clone or update", http.StatusGatewayTimeout}
 	}
+}
 
+func (h *Handler) doCloneOrUpdate(ctx context.Context, conf *Config, vcs vcs.VCS, dir string, cloneURL string, forceUpdate bool) *httpError {
 	mu := h.ensureRepoMutex(dir)
+	_, lockSpan := startSpan(ctx, "lock.update")
+	lockStart := time.Now()
 	mu.Lock()
 	defer mu.Unlock()
+	h.metrics.lockWaited("update", time.Since(lockStart))
+	lockSpan.Finish()
 
-	defer func() {
-		h.endCloneOrUpdate(dir, herr)
-	}()
+	// Log with the fields (e.g., the request ID) of the request that started
+	// the clone or update.
+	l := h.contextLogger(ctx).With("cloneURL", cloneURL, "dir", dir)
 
 	// Find or create repo dir.
 	fi, err := os.Stat(dir)
 	if err != nil && !os.IsNotExist(err) {
-		log.Print(err)
+		l.Error("error opening repo directory", "err", err)
 		return &httpError{"error opening repo directory", http.StatusInternalServerError}
 	}
 	if fi != nil && !fi.IsDir() {
 		err = errors.New("repo path is not directory")
-		log.Print(err)
+		l.Error(err.Error())
 		return &httpError{err.Error(), http.StatusInternalServerError}
 	}
 
@@ -87,34 +147,85 @@ func (h *Handler) cloneOrUpdate(vcs vcs.VCS, dir string, cloneURL string, forceU
 	if os.IsNotExist(err) {
 		err = os.MkdirAll(filepath.Dir(dir), 0700)
 		if err != nil {
-			log.Print(err)
+			l.Error("error creating repo parent directory", "err", err)
 			return &httpError{"error creating repo parent directory", http.StatusInternalServerError}
 		}
 
-		record("clone", cloneURL)
-		err = vcs.CloneMirror(cloneURL, dir)
+		if err := h.limitUpstream(conf, cloneURL); err != nil {
+			l.Warn("not cloning mirror", "reason", err.message)
+			return err
+		}
+
+		// Blame results cached for a previously evicted mirror in dir may
+		// not match the new mirror.
+		if err := conf.evictBlameCache(dir); err != nil {
+			l.Warn("failed to evict blame cache", "err", err)
+		}
+
+		_, span := startSpan(ctx, "CloneMirror")
+		start := time.Now()
+		err = conf.cloneMirror(vcs, cloneURL, dir)
+		h.metrics.mirrorOp("clone", cloneURL, time.Since(start), err != nil)
+		if err != nil {
+			span.SetError(err.Error())
+		}
+		span.Finish()
 		if err != nil {
-			log.Print(err)
+			l.Error("error cloning mirror", "err", err)
 			return &httpError{"error cloning mirror", http.StatusInternalServerError}
 		}
+		h.mirrorUpdated(dir, nil)
+		l.Info("cloned mirror", "duration", time.Since(start))
 	} else if forceUpdate {
-		record("update", cloneURL)
-		err = vcs.UpdateMirror(dir)
+		if err := h.limitUpstream(conf, cloneURL); err != nil {
+			// The existing mirror can still be served, if stale.
+			l.Info("skipping update of mirror", "reason", err.message)
+			span, _ := ctx.Value(spanKey{}).(*Span)
+			span.SetAttribute("updateRateLimited", true)
+			return nil
+		}
+
+		_, span := startSpan(ctx, "UpdateMirror")
+		start := time.Now()
+		err = conf.updateMirror(vcs, cloneURL, dir)
+		h.metrics.mirrorOp("update", cloneURL, time.Since(start), err != nil)
+		h.mirrorUpdated(dir, err)
+		if err != nil {
+			span.SetError(err.Error())
+		}
+		span.Finish()
 		if err != nil {
-			log.Print(err)
+			l.Error("error updating mirror", "err", err)
 			return &httpError{"error updating mirror", http.StatusInternalServerError}
 		}
+		l.Info("updated mirror", "duration", time.Since(start))
 	}
 
 	return nil
 }
 
-// record records an action that occurred. It currently is only used for testing
-// (to ensure that specific actions occurred), but it could be used for tracking
-// statistics in the future.
-func record(action, cloneURL string) {
-	log.Print(action + ":" + cloneURL)
-	actions[action+":"+cloneURL]++
+// cloneMirror clones a mirror of the repository at cloneURL into dir.
+func (c *Config) cloneMirror(vc vcs.VCS, cloneURL, dir string) error {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "ssh" {
+		return c.sshCloneMirror(vc, u, dir)
+	}
+	return vc.CloneMirror(cloneURL, dir)
 }
 
-var actions = make(map[string]uint)
+// updateMirror updates the mirror at dir of the repository at cloneURL.
+func (c *Config) updateMirror(vc vcs.VCS, cloneURL, dir string) error {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "ssh" {
+		if err := c.sshConfigureMirror(vc, u, dir); err != nil {
+			return err
+		}
+	}
+	return vc.UpdateMirror(dir)
+}
@@ -0,0 +1,132 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMinUpdateInterval(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Store a mirror of https://example.com/repo.
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(hostDir, "repo")
+	if err := os.Rename(makeGitRepo(t, hostDir), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(nil)
+	defer h.Close()
+	conf := &Config{
+		AccessPolicy:      *HostsPolicy([]string{"example.com"}),
+		StorageDir:        tmpdir,
+		GitBinary:         GitBinary,
+		MinUpdateInterval: Duration{time.Minute},
+	}
+	h.SetConfig(conf)
+
+	// fetch makes a request that asks for an update (like git fetch does) and
+	// returns the number of updates it attempted.
+	fetch := func(force bool) float64 {
+		pre := h.metrics.mirrorOpCount("update", "example.com")
+		req := httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil)
+		req.Header.Set("Pragma", "no-cache")
+		if force {
+			req.Header.Set(forceUpdateHeader, "1")
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return h.metrics.mirrorOpCount("update", "example.com") - pre
+	}
+
+	// The mirror has not been updated since the handler started.
+	if n := fetch(false); n != 1 {
+		t.Errorf("first fetch: got %v updates, want 1", n)
+	}
+
+	h.mirrorUpdated(dir, nil)
+	if n := fetch(false); n != 0 {
+		t.Errorf("fetch after recent update: got %v updates, want 0", n)
+	}
+	if n := fetch(true); n != 1 {
+		t.Errorf("forced fetch after recent update: got %v updates, want 1", n)
+	}
+
+	// Without a minimum interval, every fetch updates the mirror.
+	unlimited := *conf
+	unlimited.MinUpdateInterval = Duration{}
+	h.SetConfig(&unlimited)
+	h.mirrorUpdated(dir, nil)
+	if n := fetch(false); n != 1 {
+		t.Errorf("fetch without minimum interval: got %v updates, want 1", n)
+	}
+
+	// Requests that don't ask for an update don't update the mirror.
+	pre := h.metrics.mirrorOpCount("update", "example.com")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("got %d: %s", rr.Code, rr.Body)
+	}
+	if n := h.metrics.mirrorOpCount("update", "example.com") - pre; n != 0 {
+		t.Errorf("request without update: got %v updates, want 0", n)
+	}
+}
+
+func TestMinUpdateInterval_HgForwardPushes(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Store an (empty) hg mirror of https://example.com/repo.
+	dir := filepath.Join(tmpdir, "hg", "example.com", "repo")
+	if err := os.MkdirAll(filepath.Join(dir, ".hg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(nil)
+	defer h.Close()
+	conf := &Config{
+		AccessPolicy:      *HostsPolicy([]string{"example.com"}),
+		StorageDir:        tmpdir,
+		HgBinary:          filepath.Join(tmpdir, "no-hg"),
+		MinUpdateInterval: Duration{time.Minute},
+	}
+
+	// capabilities returns the number of updates that an hg capabilities
+	// request (the first request of hg pull and push) attempted.
+	capabilities := func() float64 {
+		pre := h.metrics.mirrorOpCount("update", "example.com")
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hg/https/example.com/repo/-?cmd=capabilities", nil))
+		return h.metrics.mirrorOpCount("update", "example.com") - pre
+	}
+
+	h.SetConfig(conf)
+	h.mirrorUpdated(dir, nil)
+	if n := capabilities(); n != 0 {
+		t.Errorf("capabilities after recent update: got %v updates, want 0", n)
+	}
+
+	// If pushes are forwarded, the request may be the start of a push, whose
+	// discovery must see the upstream heads.
+	forward := *conf
+	forward.Push = ForwardPushes
+	h.SetConfig(&forward)
+	h.mirrorUpdated(dir, nil)
+	if n := capabilities(); n != 1 {
+		t.Errorf("capabilities after recent update with forwarded pushes: got %v updates, want 1", n)
+	}
+}
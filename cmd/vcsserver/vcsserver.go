@@ -7,17 +7,36 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var bindAddr = flag.String("http", ":8080", "HTTP bind address")
 var storageDir = flag.String("storage", "/tmp/vcsserver", "storage root dir for VCS repos")
 var offline = flag.Bool("offline", false, "don't try to access the network; use only stored data")
+var accessFile = flag.String("access", "", "JSON file containing the access policy (host rules); overrides clone-hosts")
+var push = flag.String("push", string(vcsserver.RejectPushes), "how to handle pushes to mirrors: 'reject' (403 Forbidden) or 'forward' (to the upstream HTTP(S) repository, then update the mirror)")
+var configFile = flag.String("config", "", "JSON config file (reloaded on SIGHUP); overrides other options")
+var logLevel = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+var logJSON = flag.Bool("log-json", false, "write log messages as JSON objects (one per line)")
+var authFile = flag.String("auth", "", "JSON file containing tokens, users and/or an auth webhook; if set, all requests (except for /metrics, /healthz and /readyz) must be authenticated")
+var authorize = flag.String("authorize", "", "how to authorize access to each repository: '' (any user may access any allowed repository) or 'ls-remote' (only users whose credentials, which are forwarded upstream, can list the repository's refs there)")
+var authorizeTTL = flag.Duration("authorize-ttl", 5*time.Minute, "how long to cache -authorize decisions")
+var minUpdateInterval = flag.Duration("min-update-interval", 10*time.Second, "minimum interval between fetch-triggered updates of a mirror (fetches within it use the mirror as is unless they send X-Vcsserver-Force-Update); 0 updates on every fetch")
+var rateLimit = flag.Float64("rate-limit", 0, "maximum average requests per second from each client IP address and from each authenticated user; 0 means unlimited")
+var rateLimitBurst = flag.Int("rate-limit-burst", 10, "maximum burst of requests from each client")
+var upstreamRateLimit = flag.Float64("upstream-rate-limit", 0, "maximum average clones and updates per second from each upstream host; 0 means unlimited")
+var upstreamRateLimitBurst = flag.Int("upstream-rate-limit-burst", 5, "maximum burst of clones and updates from each upstream host")
+var trace = flag.String("trace", "", "where to export tracing spans: '' (disabled) or 'stdout' (as JSON objects, one per line)")
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "vcsserver mirrors and serves VCS repositories.\n\n")
 		fmt.Fprintf(os.Stderr, "Usage:\n\n")
-		fmt.Fprintf(os.Stderr, "\tvcsserver [options] (clone-host)+\n\n")
+		fmt.Fprintf(os.Stderr, "\tvcsserver [options] (clone-host)+\n")
+		fmt.Fprintf(os.Stderr, "\tvcsserver [options] -access=policy.json\n")
+		fmt.Fprintf(os.Stderr, "\tvcsserver [options] -config=config.json\n\n")
 		fmt.Fprintf(os.Stderr, "For each clone-host specified, vcsserver provides an HTTP proxy for cloning\n")
 		fmt.Fprintf(os.Stderr, "repositories on the host.\n\n")
 		fmt.Fprintf(os.Stderr, "The options are:\n\n")
@@ -27,19 +46,31 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Example usage:\n\n")
 		fmt.Fprintf(os.Stderr, "\tTo run a proxy for git repositories on GitHub:\n")
 		fmt.Fprintf(os.Stderr, "\t    $ vcsserver github.com\n")
+		fmt.Fprintf(os.Stderr, "\tTo allow only git repositories in one GitHub org:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ echo '{\"Hosts\": [{\"Host\": \"github.com\", \"VCS\": [\"git\"], \"Allow\": [\"ourorg/*\"]}]}' > policy.json\n")
+		fmt.Fprintf(os.Stderr, "\t    $ vcsserver -access=policy.json\n")
+		fmt.Fprintf(os.Stderr, "\tTo run with a config file and reload it without restarting:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ echo '{\"Hosts\": [{\"Host\": \"github.com\"}], \"UpdateTimeout\": \"30s\"}' > config.json\n")
+		fmt.Fprintf(os.Stderr, "\t    $ vcsserver -config=config.json &\n")
+		fmt.Fprintf(os.Stderr, "\t    $ kill -HUP %%1\n")
 		fmt.Fprintf(os.Stderr, "\tTo clone a repository via vcsserver:\n")
-		fmt.Fprintf(os.Stderr, "\t    $ HTTP_PROXY=http://localhost:8080 git clone http://github.com/user/repo.git\n")
+		fmt.Fprintf(os.Stderr, "\t    $ git clone http://localhost:8080/git/https/github.com/user/repo.git\n")
 		fmt.Fprintf(os.Stderr, "\tTo access a specific file (on the 'master' branch) via HTTP:\n")
-		fmt.Fprintf(os.Stderr, "\t    $ curl http://localhost:8080/git/github.com/user/repo.git/v/master/file.txt\n")
+		fmt.Fprintf(os.Stderr, "\t    $ curl http://localhost:8080/git/https/github.com/user/repo.git/v/master/file.txt\n")
+		fmt.Fprintf(os.Stderr, "\tIf the repository path doesn't end in .git, separate it with /-/:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ curl http://localhost:8080/hg/https/bitbucket.org/user/repo/-/v/default/file.txt\n")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintf(os.Stderr, "vcsserver reads the following environment variables:\n\n")
-		fmt.Fprintf(os.Stderr, "\tGIT_HTTP_BACKEND   path to the `git-http-backend` executable\n")
-		fmt.Fprintf(os.Stderr, "\tPYTHON27           path to the Python 2.7 interpreter\n")
+		fmt.Fprintf(os.Stderr, "\tGIT_HTTP_BACKEND   path to the `git-http-backend` executable (used for\n")
+		fmt.Fprintf(os.Stderr, "\t                   git requests other than fetches)\n")
+		fmt.Fprintf(os.Stderr, "\tHG                 path to the `hg` executable (default: found in PATH)\n")
+		fmt.Fprintf(os.Stderr, "\tPYTHON27           path to the Python 2.7 interpreter (used to serve hg\n")
+		fmt.Fprintf(os.Stderr, "\t                   repositories if `hg` is not found)\n")
 		fmt.Fprintln(os.Stderr)
 		os.Exit(1)
 	}
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && *accessFile == "" && *configFile == "" {
 		flag.Usage()
 	}
 
@@ -48,13 +79,91 @@ func main() {
 
 	vcsserver.StorageDir = *storageDir
 	vcsserver.Offline = *offline
+	vcsserver.Push = vcsserver.PushPolicy(*push)
+	vcsserver.MinUpdateInterval = *minUpdateInterval
+	vcsserver.ClientRateLimit = vcsserver.RateLimit{Rate: *rateLimit, Burst: *rateLimitBurst}
+	vcsserver.UpstreamRateLimit = vcsserver.RateLimit{Rate: *upstreamRateLimit, Burst: *upstreamRateLimitBurst}
+	if vcsserver.Push != vcsserver.RejectPushes && vcsserver.Push != vcsserver.ForwardPushes {
+		log.Fatalf("Invalid -push value: %q", *push)
+	}
+
+	level, err := vcsserver.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("Invalid -log-level value: %s", err)
+	}
 
 	cloneHosts := flag.Args()
-	http.Handle("/", vcsserver.New(cloneHosts))
+	h := vcsserver.New(cloneHosts)
+	h.Log = vcsserver.NewLogger(os.Stderr, level, *logJSON)
+	switch *trace {
+	case "":
+	case "stdout":
+		h.SpanExporter = &vcsserver.StdoutExporter{}
+	default:
+		log.Fatalf("Invalid -trace value: %q", *trace)
+	}
+	if *authFile != "" {
+		auth, err := vcsserver.LoadAuthenticator(*authFile)
+		if err != nil {
+			log.Fatalf("LoadAuthenticator: %s", err)
+		}
+		h.Authenticator = auth
+	}
+	switch *authorize {
+	case "":
+	case "ls-remote":
+		h.Authorizer = &vcsserver.CachedAuthorizer{Authorizer: &vcsserver.LsRemoteAuthorizer{}, TTL: *authorizeTTL}
+	default:
+		log.Fatalf("Invalid -authorize value: %q", *authorize)
+	}
+	if *accessFile != "" {
+		access, err := vcsserver.LoadAccessPolicy(*accessFile)
+		if err != nil {
+			log.Fatalf("LoadAccessPolicy: %s", err)
+		}
+		h.Access = access
+	}
+	if *configFile != "" {
+		loadConfig(h, h.Config())
+	}
+	http.Handle("/", h)
+
+	// Stop persistent child processes (e.g., `hg serve`) on exit.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		h.Close()
+		os.Exit(1)
+	}()
 
-	fmt.Fprintf(os.Stderr, "starting server on %s\n", *bindAddr)
-	err := http.ListenAndServe(*bindAddr, nil)
+	h.Log.Info("starting server", "addr", *bindAddr)
+	err = http.ListenAndServe(*bindAddr, nil)
 	if err != nil {
 		log.Fatalf("ListenAndServe: %s", err)
 	}
 }
+
+// loadConfig loads the config file into h, using defaults for settings not in
+// the file, and reloads it each time the process receives SIGHUP.
+func loadConfig(h *vcsserver.Handler, defaults *vcsserver.Config) {
+	conf, err := vcsserver.LoadConfig(*configFile, defaults)
+	if err != nil {
+		log.Fatalf("LoadConfig: %s", err)
+	}
+	h.SetConfig(conf)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			conf, err := vcsserver.LoadConfig(*configFile, defaults)
+			if err != nil {
+				h.Log.Error("reloading config failed (keeping previous config)", "file", *configFile, "err", err)
+				continue
+			}
+			h.SetConfig(conf)
+			h.Log.Info("reloaded config", "file", *configFile)
+		}
+	}()
+}
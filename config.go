@@ -0,0 +1,175 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config contains the settings used by a Handler to serve a request. A
+// Handler's Config may be replaced while it is running (using SetConfig);
+// requests in progress continue to use the Config that was current when they
+// began.
+type Config struct {
+	// AccessPolicy determines which repositories may be accessed.
+	AccessPolicy
+
+	// StorageDir is the root directory underneath which repositories are
+	// stored.
+	StorageDir string
+
+	// Offline is whether to skip cloning and updating repositories and only
+	// use stored data.
+	Offline bool
+
+	// GitBinary is the path to the git executable, which is used to serve git
+	// fetches.
+	GitBinary string
+
+	// GitHTTPBackend is the path to the git-http-backend executable, which is
+	// used to serve git requests other than fetches (e.g., the dumb HTTP
+	// protocol).
+	GitHTTPBackend string
+
+	// HgBinary is the path to the hg executable, which is used to serve hg
+	// repositories. If empty, hg repositories are served by running hgweb
+	// with Python27.
+	HgBinary string
+
+	// Python27 is the path to Python 2.7.
+	Python27 string
+
+	// Push is the policy for pushes to mirrored repositories. If empty, pushes
+	// are rejected.
+	Push PushPolicy
+
+	// BlameIgnores is the list of path substrings that exclude files from
+	// repository blame.
+	BlameIgnores []string
+
+	// UpdateTimeout is the maximum duration that a request waits for a
+	// repository to be cloned or updated before failing with HTTP 504
+	// Gateway Timeout. The clone or update continues in the background. If
+	// zero, requests wait indefinitely.
+	UpdateTimeout Duration
+
+	// MinUpdateInterval is the minimum interval between updates of a mirror
+	// that are triggered by fetches (which always request an update). A
+	// fetch within the interval after an update uses the mirror as is,
+	// unless it has the X-Vcsserver-Force-Update header. If zero, every
+	// fetch updates the mirror.
+	MinUpdateInterval Duration
+
+	// MinFreeSpace is the number of bytes that must be free on the file
+	// system containing StorageDir for the server to be reported healthy. If
+	// zero, 1 GiB is required.
+	MinFreeSpace int64
+
+	// AdminToken is the bearer token that authorizes requests to the admin
+	// API (under /admin/). If empty, the admin API is disabled.
+	AdminToken string
+
+	// HookSecrets maps the names of upstream hosting providers ("github",
+	// "gitlab" or "bitbucket") to the secrets of their webhooks, which
+	// notify vcsserver of pushes at /hooks/<provider>. Providers without a
+	// secret can't notify vcsserver.
+	HookSecrets map[string]string
+
+	// ClientRateLimit limits the rate of requests from each client IP
+	// address (checked before authentication) and, separately, from each
+	// authenticated user. Requests that exceed it fail with HTTP 429 Too
+	// Many Requests.
+	ClientRateLimit RateLimit
+
+	// UpstreamRateLimit limits the rate of clones and updates from each
+	// upstream host. Requests that would exceed it fail with HTTP 429 Too
+	// Many Requests.
+	UpstreamRateLimit RateLimit
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string in the
+// format accepted by time.ParseDuration (e.g., "30s").
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// DefaultConfig returns a Config whose settings are taken from the package
+// variables (StorageDir, Offline, etc.). It allows access to no hosts.
+func DefaultConfig() *Config {
+	return &Config{
+		StorageDir:     StorageDir,
+		Offline:        Offline,
+		GitBinary:      GitBinary,
+		GitHTTPBackend: GitHTTPBackend,
+		HgBinary:       HgBinary,
+		Python27:       Python27,
+		Push:           Push,
+		BlameIgnores:   blameIgnores,
+
+		MinUpdateInterval: Duration{MinUpdateInterval},
+		ClientRateLimit:   ClientRateLimit,
+		UpstreamRateLimit: UpstreamRateLimit,
+	}
+}
+
+// LoadConfig reads a JSON-encoded Config from the named file. Settings that
+// are not present in the file are taken from defaults.
+func LoadConfig(filename string, defaults *Config) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Decode into a deep copy of defaults so that defaults is not modified.
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Config returns the Config that h currently uses to serve requests.
+func (h *Handler) Config() *Config {
+	h.configLock.RLock()
+	defer h.configLock.RUnlock()
+	if h.config != nil {
+		return h.config
+	}
+	c := DefaultConfig()
+	c.AccessPolicy = *h.accessPolicy()
+	return c
+}
+
+// SetConfig replaces the Config that h uses to serve requests. Requests in
+// progress are not affected. After SetConfig is called, h's Hosts and Access
+// fields and the package variables are no longer consulted.
+func (h *Handler) SetConfig(c *Config) {
+	h.configLock.Lock()
+	defer h.configLock.Unlock()
+	h.config = c
+}
@@ -0,0 +1,60 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "vcsserver-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"Hosts": [{"Host": "example.com"}], "StorageDir": "/tmp/foo", "UpdateTimeout": "30s"}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := &Config{
+		AccessPolicy: AccessPolicy{Hosts: []*HostRule{{Host: "github.com"}}},
+		StorageDir:   "/tmp/vcsserver",
+		Python27:     "/usr/bin/python2.7",
+		BlameIgnores: []string{"vendor"},
+	}
+	conf, err := LoadConfig(f.Name(), defaults)
+	if err != nil {
+		t.Fatal("LoadConfig:", err)
+	}
+
+	want := &Config{
+		AccessPolicy:  AccessPolicy{Hosts: []*HostRule{{Host: "example.com"}}},
+		StorageDir:    "/tmp/foo",
+		Python27:      "/usr/bin/python2.7",
+		BlameIgnores:  []string{"vendor"},
+		UpdateTimeout: Duration{30 * time.Second},
+	}
+	if !reflect.DeepEqual(want, conf) {
+		t.Errorf("want config %+v, got %+v", want, conf)
+	}
+	if defaults.Hosts[0].Host != "github.com" {
+		t.Errorf("LoadConfig modified defaults: got host %q", defaults.Hosts[0].Host)
+	}
+}
+
+func TestHandler_SetConfig(t *testing.T) {
+	h := New([]string{"github.com"})
+	if conf := h.Config(); !reflect.DeepEqual(conf.AccessPolicy, *HostsPolicy([]string{"github.com"})) {
+		t.Errorf("want default config to allow Handler.Hosts, got %+v", conf.AccessPolicy)
+	}
+
+	conf := &Config{StorageDir: "/tmp/foo"}
+	h.SetConfig(conf)
+	if got := h.Config(); got != conf {
+		t.Errorf("want config %+v after SetConfig, got %+v", conf, got)
+	}
+}
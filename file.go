@@ -2,7 +2,6 @@ package vcsserver
 
 import (
 	"github.com/sourcegraph/go-vcs"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -15,9 +14,16 @@ func file(w http.ResponseWriter, r *http.Request, vc vcs.VCS, dir string, extraP
 		return &httpError{"bad file path", http.StatusNotFound}
 	}
 	rev, path := parts[0], parts[1]
+	if herr := checkRev(rev); herr != nil {
+		return herr
+	}
+	path, herr := cleanFilePath(path)
+	if herr != nil {
+		return herr
+	}
 	v, err := vc.Open(dir)
 	if err != nil {
-		log.Print(err)
+		requestLogger(r).Error("failed to open repository", "err", err)
 		return &httpError{"failed to open repository", http.StatusInternalServerError}
 	}
 
@@ -25,7 +31,7 @@ func file(w http.ResponseWriter, r *http.Request, vc vcs.VCS, dir string, extraP
 	if os.IsNotExist(err) {
 		return &httpError{"not found", http.StatusNotFound}
 	} else if err != nil {
-		log.Print(err)
+		requestLogger(r).Error("failed to read file at revision", "err", err)
 		return &httpError{"failed to read file at revision", http.StatusInternalServerError}
 	}
 	if filetype == vcs.Dir {
@@ -0,0 +1,143 @@
+package vcsserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+// GitBinary is the path to the git executable. It is the default for
+// Config.GitBinary.
+var GitBinary = "git"
+
+// serveGitSmartHTTP serves requests of git's smart HTTP protocol for fetching
+// (info/refs?service=git-upload-pack and git-upload-pack) by running git
+// upload-pack on the repository at dir. Protocol v2 (requested by the client
+// in the Git-Protocol header), partial clones and shallow fetches are
+// supported. It returns false if the request is not one of these requests.
+func serveGitSmartHTTP(w http.ResponseWriter, r *http.Request, conf *Config, dir, extraPath string) (bool, *httpError) {
+	switch {
+	case extraPath == "/info/refs" && r.Method == "GET" && r.URL.Query().Get("service") == "git-upload-pack":
+		return true, gitAdvertiseRefs(w, r, conf, dir)
+	case extraPath == "/git-upload-pack" && r.Method == "POST":
+		return true, gitUploadPack(w, r, conf, dir)
+	}
+	return false, nil
+}
+
+// gitProtocolPattern matches valid values of the Git-Protocol request header
+// (e.g., "version=2"), which is passed to git in the GIT_PROTOCOL environment
+// variable.
+var gitProtocolPattern = regexp.MustCompile(`^[a-zA-Z0-9=:._-]+$`)
+
+// gitProtocol returns the git protocol parameters requested by the client in
+// the Git-Protocol header, or "" if there are none (or they are invalid).
+func gitProtocol(r *http.Request) string {
+	p := r.Header.Get("Git-Protocol")
+	if !gitProtocolPattern.MatchString(p) {
+		return ""
+	}
+	return p
+}
+
+// uploadPackCmd returns a command that runs git upload-pack on the repository
+// at dir with the specified args and the protocol parameters requested by the
+// client. Filters (for partial clones) are allowed.
+func uploadPackCmd(r *http.Request, conf *Config, dir string, args ...string) *exec.Cmd {
+	args = append([]string{"-c", "uploadpack.allowFilter=true", "upload-pack", "--stateless-rpc"}, args...)
+	cmd := exec.Command(conf.GitBinary, append(args, ".")...)
+	cmd.Dir = dir
+	if p := gitProtocol(r); p != "" {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+p)
+	}
+	return cmd
+}
+
+func gitAdvertiseRefs(w http.ResponseWriter, r *http.Request, conf *Config, dir string) *httpError {
+	var stdout, stderr bytes.Buffer
+	cmd := uploadPackCmd(r, conf, dir, "--advertise-refs")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		requestLogger(r).Error("failed to list refs", "dir", dir, "err", err, "stderr", stderr.String())
+		return &httpError{"failed to list refs", http.StatusInternalServerError}
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	if !bytes.HasPrefix(stdout.Bytes(), pktLine("version 2\n")) {
+		// Protocol v0 and v1 responses begin with the service name. (Protocol
+		// v2 responses begin with the capability advertisement.)
+		w.Write(pktLine("# service=git-upload-pack\n"))
+		w.Write([]byte("0000"))
+	}
+	w.Write(stdout.Bytes())
+	return nil
+}
+
+func gitUploadPack(w http.ResponseWriter, r *http.Request, conf *Config, dir string) *httpError {
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-git-upload-pack-request" {
+		return &httpError{"bad content type " + ct, http.StatusUnsupportedMediaType}
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return &httpError{"bad gzip request body", http.StatusBadRequest}
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var stderr bytes.Buffer
+	out := &flushWriter{w: w}
+	cmd := uploadPackCmd(r, conf, dir)
+	cmd.Stdin = body
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	if err := cmd.Run(); err != nil {
+		requestLogger(r).Error("git upload-pack failed", "dir", dir, "err", err, "stderr", stderr.String())
+		if !out.written {
+			return &httpError{"git upload-pack failed", http.StatusInternalServerError}
+		}
+		// too late to return an HTTP error
+	}
+	return nil
+}
+
+// pktLine returns s encoded as a git pkt-line.
+func pktLine(s string) []byte {
+	const hex = "0123456789abcdef"
+	n := len(s) + 4
+	return append([]byte{hex[n>>12&0xf], hex[n>>8&0xf], hex[n>>4&0xf], hex[n&0xf]}, s...)
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// flushWriter flushes the underlying ResponseWriter (if it is an http.Flusher)
+// after each write, so that responses are streamed to the client in chunks as
+// they are produced.
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool // whether anything has been written
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.written = fw.written || len(p) > 0
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,248 @@
+package vcsserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeGitRepo creates a bare git repository underneath tmpdir whose master
+// branch contains two commits that add and modify a file named foo. It returns
+// the path to the repository.
+func makeGitRepo(t *testing.T, tmpdir string) string {
+	cmd := exec.Command("sh", "-c", `
+set -e
+git init -q work
+cd work
+echo 'Hello, foo' > foo
+git add foo
+git -c user.name=a -c user.email=a@example.com commit -q -m init
+echo 'Hello, foo!!!' > foo
+git -c user.name=a -c user.email=a@example.com commit -q -a -m update
+git branch -q -M master
+cd ..
+git clone -q --bare work repo.git
+`)
+	cmd.Dir = tmpdir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("creating git repo: %s (output: %s)", err, out)
+	}
+	return filepath.Join(tmpdir, "repo.git")
+}
+
+// newGitSmartHTTPServer returns a test server that serves the repository at
+// dir at the URL path /repo.git using serveGitSmartHTTP.
+func newGitSmartHTTPServer(dir string) *httptest.Server {
+	conf := &Config{GitBinary: GitBinary}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, err := serveGitSmartHTTP(w, r, conf, dir, strings.TrimPrefix(r.URL.Path, "/repo.git"))
+		if !ok {
+			http.Error(w, "not a smart HTTP request", http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+	}))
+}
+
+func TestGitSmartHTTP_Clone(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-githttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := newGitSmartHTTPServer(makeGitRepo(t, tmpdir))
+	defer s.Close()
+
+	localRepoDir := filepath.Join(tmpdir, "clone")
+	if out, err := exec.Command("git", "clone", "-q", s.URL+"/repo.git", localRepoDir).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %s (output: %s)", err, out)
+	}
+	if f := filepath.Join(localRepoDir, "foo"); !isFile(f) {
+		t.Errorf("want file %s to exist", f)
+	}
+}
+
+func TestGitSmartHTTP_AdvertiseRefs(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-githttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := newGitSmartHTTPServer(makeGitRepo(t, tmpdir))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/repo.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := string(readAll(t, resp.Body))
+	if want := "application/x-git-upload-pack-advertisement"; resp.Header.Get("Content-Type") != want {
+		t.Errorf("want Content-Type %q, got %q", want, resp.Header.Get("Content-Type"))
+	}
+	if want := "001e# service=git-upload-pack\n0000"; !strings.HasPrefix(body, want) {
+		t.Errorf("want body to begin with %q, got %q", want, body)
+	}
+	if !strings.Contains(body, "refs/heads/master") {
+		t.Errorf("want body to advertise refs/heads/master, got %q", body)
+	}
+}
+
+func TestGitSmartHTTP_ProtocolV2(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-githttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := newGitSmartHTTPServer(makeGitRepo(t, tmpdir))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := string(readAll(t, resp.Body))
+	if want := "000eversion 2\n"; !strings.HasPrefix(body, want) {
+		t.Errorf("want body to begin with %q, got %q", want, body)
+	}
+	if !strings.Contains(body, "ls-refs") || !strings.Contains(body, "fetch=") {
+		t.Errorf("want body to advertise ls-refs and fetch, got %q", body)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string // file that must exist in the clone's .git dir
+	}{
+		{name: "full", want: "HEAD"},
+		{name: "partial", args: []string{"--filter=blob:none"}, want: "objects/pack"},
+		{name: "shallow", args: []string{"--depth=1"}, want: "shallow"},
+	}
+	for _, test := range tests {
+		localRepoDir := filepath.Join(tmpdir, test.name)
+		args := append([]string{"-c", "protocol.version=2", "clone", "-q"}, test.args...)
+		cmd := exec.Command("git", append(args, s.URL+"/repo.git", localRepoDir)...)
+		cmd.Env = append(os.Environ(), "GIT_TRACE_PACKET="+filepath.Join(tmpdir, test.name+".trace"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%s: git clone: %s (output: %s)", test.name, err, out)
+			continue
+		}
+		if f := filepath.Join(localRepoDir, "foo"); !isFile(f) {
+			t.Errorf("%s: want file %s to exist", test.name, f)
+		}
+		if _, err := os.Stat(filepath.Join(localRepoDir, ".git", test.want)); err != nil {
+			t.Errorf("%s: want %s to exist in clone: %s", test.name, test.want, err)
+		}
+		trace, err := ioutil.ReadFile(filepath.Join(tmpdir, test.name+".trace"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(trace, []byte("command=ls-refs")) {
+			t.Errorf("%s: want clone to use protocol v2 ls-refs", test.name)
+		}
+	}
+
+	// Check that the partial clone fetches missing blobs from the server.
+	out, err := exec.Command("git", "-C", filepath.Join(tmpdir, "partial"), "config", "remote.origin.promisor").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "true" {
+		t.Errorf("want partial clone to have a promisor remote, got %q (%v)", out, err)
+	}
+}
+
+func TestGitSmartHTTP_GzipRequest(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-githttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := makeGitRepo(t, tmpdir)
+	s := newGitSmartHTTPServer(dir)
+	defer s.Close()
+
+	out, err := exec.Command("git", "--git-dir="+dir, "rev-parse", "master").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req, gzreq bytes.Buffer
+	req.Write(pktLine("want " + strings.TrimSpace(string(out)) + "\n"))
+	req.WriteString("0000")
+	req.Write(pktLine("done\n"))
+	gz := gzip.NewWriter(&gzreq)
+	gz.Write(req.Bytes())
+	gz.Close()
+
+	httpReq, err := http.NewRequest("POST", s.URL+"/repo.git/git-upload-pack", &gzreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := readAll(t, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want status 200, got %d (body: %q)", resp.StatusCode, body)
+	}
+	if want := "0008NAK\n"; !bytes.HasPrefix(body, []byte(want)) {
+		t.Errorf("want body to begin with %q, got %q", want, body)
+	}
+	if !bytes.Contains(body, []byte("PACK")) {
+		t.Errorf("want body to contain a packfile, got %q", body)
+	}
+}
+
+func TestGitSmartHTTP_UploadPackFailure(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-githttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// git upload-pack fails without writing anything if the repository is
+	// deleted (e.g., by an admin) before the request is served.
+	dir := makeGitRepo(t, tmpdir)
+	s := newGitSmartHTTPServer(dir)
+	defer s.Close()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var req bytes.Buffer
+	req.Write(pktLine("want 0123456789012345678901234567890123456789\n"))
+	req.WriteString("0000")
+	req.Write(pktLine("done\n"))
+	resp, err := http.Post(s.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body := readAll(t, resp.Body); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("want status 500, got %d (body: %q)", resp.StatusCode, body)
+	}
+}
+
+func TestPktLine(t *testing.T) {
+	if got, want := string(pktLine("# service=git-upload-pack\n")), "001e# service=git-upload-pack\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -4,43 +4,203 @@ import (
 	"github.com/sourcegraph/go-vcs"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Offline is whether to skip cloning and updating repositories and only use
+// stored data. It is the default for Config.Offline.
 var Offline bool
 
 // Handler contains settings for vcsserver and implements http.Handler.
 type Handler struct {
-	// Hosts is a whitelist of hosts whose repositories may be accessed.
+	// Hosts is a whitelist of hosts whose repositories may be accessed. It is
+	// only consulted if Access is nil.
 	Hosts []string
 
+	// Access, if non-nil, determines which repositories may be accessed. It
+	// is only consulted if no Config has been set with SetConfig.
+	Access *AccessPolicy
+
+	configLock sync.RWMutex
+	config     *Config
+
 	currentlyUpdatingLock sync.Mutex
 	currentlyUpdating     map[string][]chan *httpError
 
 	repoAccessLock sync.Mutex
 	repoAccess     map[string]*sync.Mutex
+
+	mirrorsLock sync.Mutex
+	mirrors     map[string]*mirrorState // repo dir -> state
+
+	readinessLock sync.Mutex
+	readiness     *cachedReadiness
+
+	// SpanExporter, if non-nil, receives tracing spans for each request and
+	// its phases (e.g., clones and updates, lock waits and backends).
+	// Incoming W3C traceparent headers are honored.
+	SpanExporter SpanExporter
+
+	// Log, if non-nil, receives log messages, including an access log entry
+	// for each request. If nil, messages are logged to stderr.
+	Log *Logger
+
+	// Authenticator, if non-nil, authenticates all requests except those for
+	// metrics and health checks. If nil, only admin API requests are
+	// authenticated (with Config.AdminToken).
+	Authenticator Authenticator
+
+	// Authorizer, if non-nil, decides whether each request may access the
+	// requested repository (e.g., because the user may access it upstream).
+	Authorizer Authorizer
+
+	hgServers *hgServerPool
+
+	metrics *metrics
+
+	clientLimiter   *rateLimiter
+	upstreamLimiter *rateLimiter
 }
 
 func New(hosts []string) *Handler {
 	enableBlameLog()
-	return &Handler{
+	h := &Handler{
 		Hosts:             hosts,
 		currentlyUpdating: make(map[string][]chan *httpError),
 		repoAccess:        make(map[string]*sync.Mutex),
+		mirrors:           make(map[string]*mirrorState),
+		metrics:           newMetrics(),
+		clientLimiter:     newRateLimiter(),
+		upstreamLimiter:   newRateLimiter(),
 	}
+	h.hgServers = newHgServerPool(h.logger)
+	return h
+}
+
+// Close stops the persistent processes (e.g., `hg serve`) started by h.
+func (h *Handler) Close() {
+	h.hgServers.closeAll()
 }
 
 // Router constructs a handler that provides cloning and file access.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	route, err := router(h.Hosts, r.URL.Path)
+	conf := h.Config()
+	if r.URL.Path == metricsPath {
+		h.serveMetrics(w, r, conf)
+		return
+	}
+	if r.URL.Path == healthzPath || r.URL.Path == readyzPath {
+		h.serveHealth(w, r, conf)
+		return
+	}
+
+	// Log the request with its ID, and record its action, status code and
+	// duration.
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+	l := h.logger().With("requestID", id)
+	r = withLogger(r, l)
+	r, span := startRequestSpan(r, h.SpanExporter, "ServeHTTP")
+	defer span.Finish()
+	start := time.Now()
+	rec := newRecorder(w)
+	w = rec
+	var route *route
+	var ident *Identity
+	requestAction := noAction
+	defer func() {
+		code := rec.Code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		duration := time.Since(start)
+		fields := []interface{}{"method", r.Method, "path", r.URL.Path}
+		if route != nil {
+			fields = append(fields, "vcs", route.vcs.ShortName(), "repo", route.uri)
+		}
+		if ident != nil {
+			fields = append(fields, "user", ident.User)
+		}
+		fields = append(fields, "action", string(requestAction), "status", code, "bytes", rec.BodyLength, "duration", duration)
+		l.Info("request", fields...)
+		for i := 0; i+1 < len(fields); i += 2 {
+			span.SetAttribute(fields[i].(string), fields[i+1])
+		}
+		span.SetAttribute("requestID", id)
+		if code >= 500 {
+			span.SetError(http.StatusText(code))
+		}
+		h.metrics.request(requestAction, code, duration)
+	}()
+
+	if err := h.limitClient(w, r, conf); err != nil {
+		http.Error(w, err.message, err.statusCode)
+		return
+	}
+
+	// Push notifications are authenticated by their signatures.
+	if strings.HasPrefix(r.URL.Path, hooksPathPrefix) {
+		requestAction = hookAction
+		if err := h.serveHook(w, r, conf, strings.TrimPrefix(r.URL.Path, hooksPathPrefix)); err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+		return
+	}
+
+	ident, err := h.authenticate(r, conf)
+	if err != nil {
+		http.Error(w, err.message, err.statusCode)
+		return
+	}
+	if ident != nil {
+		if err := h.limitUser(w, conf, ident); err != nil {
+			http.Error(w, err.message, err.statusCode)
+			return
+		}
+		r = withIdentity(r, ident)
+	}
+
+	if strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+		requestAction = adminAction
+		err = h.authorize(w, conf, ident, adminAction)
+		if err == nil {
+			err = h.serveAdmin(w, r, conf)
+		}
+		if err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+		return
+	}
+
+	route, err = router(&conf.AccessPolicy, r.URL.Path)
 	if err != nil {
 		http.Error(w, err.message, err.statusCode)
 		return
 	}
+	requestAction = route.action
+	if err := h.authorize(w, conf, ident, route.action); err != nil {
+		http.Error(w, err.message, err.statusCode)
+		return
+	}
+	if err := h.authorizeRepo(w, r, route); err != nil {
+		http.Error(w, err.message, err.statusCode)
+		return
+	}
+
+	dir := conf.repoDir(route.vcs, route.uri)
+
+	// Pushes are rejected or forwarded to the upstream repository, never
+	// applied to the mirror.
+	if isPush(route.vcs, r, route.extraPath) {
+		if err := h.push(w, r, conf, route, dir); err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+		return
+	}
 
 	// If this is the first op in a transaction, then update the repo
 	// from the remote. (We don't want to try to update it for each op in a
@@ -55,28 +215,55 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// `cmd=capabilities`.
 		forceUpdate = true
 	}
+	// hg push discovers the upstream heads from the mirror before its unbundle
+	// is forwarded, and upstream rejects the push if they are stale. Pushes
+	// can't be told apart from pulls until then, so if pushes are forwarded,
+	// hg requests that ask for an update always get one.
+	hgMayPush := route.vcs == vcs.Hg && conf.Push == ForwardPushes
+	if r.Header.Get(forceUpdateHeader) != "" {
+		// The caller needs the latest upstream data, even if the mirror
+		// was just updated.
+		forceUpdate = true
+	} else if forceUpdate && !hgMayPush && h.updatedWithin(dir, conf.MinUpdateInterval.Duration) {
+		// The mirror was updated recently enough to satisfy this fetch.
+		forceUpdate = false
+		span.SetAttribute("updateDebounced", true)
+		l.Debug("skipping update of recently updated mirror", "cloneURL", route.cloneURL)
+	}
 
 	// Clone or update the requested repo.
-	dir := repoDir(route.vcs, route.uri)
-	err = h.cloneOrUpdate(route.vcs, dir, route.cloneURL, forceUpdate)
+	err = h.cloneOrUpdate(r.Context(), conf, route.vcs, dir, route.cloneURL, forceUpdate)
 	if err != nil {
+		err = h.upstreamRetryAfter(w, conf, route.cloneURL, err)
 		http.Error(w, err.message, err.statusCode)
 		return
 	}
+	if isMirrorDir(route.vcs.ShortName(), dir) {
+		// (In offline mode, the mirror might not exist.)
+		h.mirrorAccessed(dir, route.cloneURL)
+	}
 
 	mu := h.ensureRepoMutex(dir)
+	_, lockSpan := startSpan(r.Context(), "lock.repo")
+	lockStart := time.Now()
 	mu.Lock()
 	defer mu.Unlock()
+	h.metrics.lockWaited("repo", time.Since(lockStart))
+	lockSpan.Finish()
 
 	switch route.action {
 	case proxyAction:
-		err = proxy(w, r, route, dir)
+		err = proxy(w, r, conf, h.hgServers, route, dir)
 	case singleFileAction:
 		err = file(w, r, route.vcs, dir, route.extraPath)
 	case batchFileAction:
 		err = batchFile(w, r, route.vcs, dir, route.extraPath)
 	case blameAction:
-		err = blameRepository(w, r, route.vcs, dir)
+		err = blameRepository(w, r, conf, route.vcs, dir, mu)
+	case fileBlameAction:
+		err = blameFile(w, r, conf, route.vcs, dir, route.extraPath)
+	case authorshipAction:
+		err = authorship(w, r, conf, route.vcs, dir)
 	default:
 		panic("unknown action: " + string(route.action))
 	}
@@ -86,6 +273,15 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// accessPolicy returns h.Access, or a policy allowing access to h.Hosts if
+// h.Access is nil.
+func (h *Handler) accessPolicy() *AccessPolicy {
+	if h.Access != nil {
+		return h.Access
+	}
+	return HostsPolicy(h.Hosts)
+}
+
 func (h *Handler) ensureRepoMutex(dir string) *sync.Mutex {
 	h.repoAccessLock.Lock()
 	defer h.repoAccessLock.Unlock()
@@ -99,10 +295,23 @@ func (h *Handler) ensureRepoMutex(dir string) *sync.Mutex {
 type action string
 
 const (
+	// noAction is the action of requests whose path is not routed (and
+	// which fail).
+	noAction action = "none"
+
 	proxyAction      action = "proxy"
 	singleFileAction        = "singleFile"
 	batchFileAction         = "batchFile"
 	blameAction             = "blame"
+	fileBlameAction         = "fileBlame"
+	authorshipAction        = "authorship"
+
+	// adminAction is the action of admin API requests (which are not
+	// routed to a repository).
+	adminAction = "admin"
+
+	// hookAction is the action of push notifications from upstream hosts.
+	hookAction = "hook"
 )
 
 type httpError struct {
@@ -111,54 +320,86 @@ type httpError struct {
 }
 
 type route struct {
-	vcs           vcs.VCS
-	cloneURL, uri string
-	action        action
-	extraPath     string
-}
+	vcs      vcs.VCS
+	cloneURL string
 
-var pathPattern = regexp.MustCompile(`^/(?P<pathComponents>\d+)/(?P<vcs>git|hg)/(?P<scheme>http|https|git)/(?P<host>[a-zA-Z0-9.-]+)/(?P<path>.*)$`)
+	// uri identifies the repository's mirror. It is the same for all
+	// equivalent clone URLs.
+	uri string
 
-func router(hosts []string, path string) (*route, *httpError) {
-	m := pathPattern.FindStringSubmatch(path)
-	if m == nil {
-		return nil, &httpError{"bad path", http.StatusNotFound}
-	}
+	action    action
+	extraPath string
+}
 
-	numPathComponents, err := strconv.Atoi(m[1])
-	if err != nil {
-		return nil, &httpError{"first path component must be number of path components in repo", http.StatusBadRequest}
-	}
+// hostPattern matches a host name or bracketed IPv6 address, optionally
+// followed by a port (e.g., "example.com", "example.com:8443" or "[::1]:8443").
+const hostPattern = `(?:[a-zA-Z0-9.-]+|\[[0-9a-fA-F:.]+\])(?::[0-9]+)?`
+
+// legacyPathPattern matches paths of the form
+// /<N>/<vcs>/<scheme>/<host>/<path>, where N is the number of path components
+// in <path> that make up the repository path.
+var legacyPathPattern = regexp.MustCompile(`^/(?P<pathComponents>\d+)/(?P<vcs>git|hg)/(?P<scheme>http|https|git|ssh)/(?P<host>` + hostPattern + `)/(?P<path>.*)$`)
 
-	vcsName, scheme, host, path := m[2], m[3], m[4], m[5]
+// pathPattern matches paths of the form /<vcs>/<scheme>/<host>/<path>, where
+// the repository path in <path> is terminated by a "/-/" separator (or a
+// trailing "/-"), or else by the first path component ending in ".git".
+var pathPattern = regexp.MustCompile(`^/(?P<vcs>git|hg)/(?P<scheme>http|https|git|ssh)/(?P<host>` + hostPattern + `)/(?P<path>.*)$`)
 
-	// Check that specified host is in list of allowable hosts.
-	hostOK := false
-	for _, okHost := range hosts {
-		if okHost == host {
-			hostOK = true
-			break
+func router(access *AccessPolicy, path string) (*route, *httpError) {
+	var vcsName, scheme, host, repoPath, extraPath string
+	if m := legacyPathPattern.FindStringSubmatch(path); m != nil {
+		numPathComponents, atoiErr := strconv.Atoi(m[1])
+		if atoiErr != nil {
+			return nil, &httpError{"first path component must be number of path components in repo", http.StatusBadRequest}
 		}
-	}
-	if !hostOK {
-		return nil, &httpError{"access to specified host is not allowed", http.StatusForbidden}
+		vcsName, scheme, host = m[2], m[3], m[4]
+		repoPath, extraPath = bisectBeforeNth(m[5], "/", numPathComponents)
+	} else if m := pathPattern.FindStringSubmatch(path); m != nil {
+		vcsName, scheme, host = m[1], m[2], m[3]
+		var ok bool
+		repoPath, extraPath, ok = splitRepoPath(m[4])
+		if !ok {
+			return nil, &httpError{"repo path must end in .git or be followed by /-/", http.StatusNotFound}
+		}
+	} else {
+		return nil, &httpError{"bad path", http.StatusNotFound}
 	}
 
+	repoPath, err := cleanRepoPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
 	cloneURL := &url.URL{
 		Scheme: scheme,
 		Host:   strings.ToLower(host),
+		Path:   "/" + repoPath,
 	}
-	repoPath, extraPath := bisectBeforeNth(path, "/", numPathComponents)
-	cloneURL.Path = "/" + filepath.Clean(repoPath)
-	uri := cloneURL.Host + cloneURL.Path
+
+	// Check that the specified repository may be accessed.
+	rule, err := access.check(vcsName, scheme, cloneURL.Host, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Equivalent clone URLs (e.g., with and without ".git") share a mirror,
+	// which is identified by uri.
+	canonicalPath := canonicalRepoPath(repoPath, rule.caseInsensitive(cloneURL.Host))
+	if canonicalPath == "" {
+		return nil, &httpError{"empty repo path", http.StatusNotFound}
+	}
+	uri := cloneURL.Host + "/" + canonicalPath
 
 	var action action
 	if strings.HasPrefix(extraPath, "/v/") {
 		action = singleFileAction
 	} else if strings.HasPrefix(extraPath, "/v-batch/") {
 		action = batchFileAction
+	} else if strings.HasPrefix(extraPath, "/api/blame/") {
+		action = fileBlameAction
 	} else if strings.HasPrefix(extraPath, "/api/blame") {
 		action = blameAction
+	} else if strings.HasPrefix(extraPath, "/api/authorship") {
+		action = authorshipAction
 	} else {
 		action = proxyAction
 	}
@@ -172,6 +413,39 @@ func router(hosts []string, path string) (*route, *httpError) {
 	}, nil
 }
 
+// repoPathSeparator separates the repository path from the rest of the request
+// path when the repository path does not end in ".git".
+const repoPathSeparator = "-"
+
+// splitRepoPath splits p into the repository path and the remaining path
+// (which, if non-empty, begins with "/"). The repository path ends at the
+// first terminator: either before a "-" path component or after a path
+// component ending in ".git" (and any "-" that follows it). If neither is
+// present, ok is false.
+func splitRepoPath(p string) (repoPath, extraPath string, ok bool) {
+	components := strings.Split(p, "/")
+	for i, c := range components {
+		var end, rest int
+		switch {
+		case c == repoPathSeparator && i > 0:
+			end, rest = i, i+1
+		case strings.HasSuffix(c, ".git") && c != ".git":
+			end, rest = i+1, i+1
+			if rest < len(components) && components[rest] == repoPathSeparator {
+				rest++ // redundant separator (e.g., "a.git/-/v/...")
+			}
+		default:
+			continue
+		}
+		repoPath = strings.Join(components[:end], "/")
+		if rest < len(components) {
+			extraPath = "/" + strings.Join(components[rest:], "/")
+		}
+		return repoPath, extraPath, true
+	}
+	return "", "", false
+}
+
 // bisectBeforeNth splits s into 2 strings on the nth occurrence of sep.
 func bisectBeforeNth(s string, sep string, n int) (string, string) {
 	seen := 0
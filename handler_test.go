@@ -2,6 +2,7 @@ package vcsserver
 
 import (
 	"github.com/sourcegraph/go-vcs"
+	"net/http"
 	"reflect"
 	"testing"
 )
@@ -46,10 +47,161 @@ func TestRouter(t *testing.T) {
 				extraPath: "/v/mybranch/mydir/myfile.txt",
 			},
 		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/https/example.com/a/myrepo.git/info/refs",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "https://example.com/a/myrepo.git",
+				uri:       "example.com/a/myrepo",
+				action:    proxyAction,
+				extraPath: "/info/refs",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/hg/https/example.com/a/myrepo/-",
+			wantRoute: &route{
+				vcs:       vcs.Hg,
+				cloneURL:  "https://example.com/a/myrepo",
+				uri:       "example.com/a/myrepo",
+				action:    proxyAction,
+				extraPath: "",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/git/example.com/a/myrepo/-/v/mybranch/mydir/myfile.txt",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "git://example.com/a/myrepo",
+				uri:       "example.com/a/myrepo",
+				action:    singleFileAction,
+				extraPath: "/v/mybranch/mydir/myfile.txt",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/git/example.com/a/myrepo.git/-/api/blame",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "git://example.com/a/myrepo.git",
+				uri:       "example.com/a/myrepo",
+				action:    blameAction,
+				extraPath: "/api/blame",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/git/example.com/a/myrepo.git/api/authorship",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "git://example.com/a/myrepo.git",
+				uri:       "example.com/a/myrepo",
+				action:    authorshipAction,
+				extraPath: "/api/authorship",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/git/example.com/a/myrepo.git/api/blame/master/mydir/myfile.txt",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "git://example.com/a/myrepo.git",
+				uri:       "example.com/a/myrepo",
+				action:    fileBlameAction,
+				extraPath: "/api/blame/master/mydir/myfile.txt",
+			},
+		},
+		{
+			hosts: []string{"git.example.com"},
+			path:  "/git/ssh/git.example.com/group/myrepo.git/info/refs",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "ssh://git.example.com/group/myrepo.git",
+				uri:       "git.example.com/group/myrepo",
+				action:    proxyAction,
+				extraPath: "/info/refs",
+			},
+		},
+		{
+			hosts: []string{"git.example.com:8443"},
+			path:  "/git/https/git.example.com:8443/myrepo.git/info/refs",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "https://git.example.com:8443/myrepo.git",
+				uri:       "git.example.com:8443/myrepo",
+				action:    proxyAction,
+				extraPath: "/info/refs",
+			},
+		},
+		{
+			hosts: []string{"[::1]:8080"},
+			path:  "/1/hg/http/[::1]:8080/myrepo",
+			wantRoute: &route{
+				vcs:       vcs.Hg,
+				cloneURL:  "http://[::1]:8080/myrepo",
+				uri:       "[::1]:8080/myrepo",
+				action:    proxyAction,
+				extraPath: "",
+			},
+		},
+		{
+			hosts: []string{"example.com"},
+			path:  "/git/https/example.com/A/MyRepo/-/v/master/foo",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "https://example.com/A/MyRepo",
+				uri:       "example.com/A/MyRepo",
+				action:    singleFileAction,
+				extraPath: "/v/master/foo",
+			},
+		},
+		{
+			hosts: []string{"github.com"},
+			path:  "/git/https/github.com/A/MyRepo/-/v/master/foo",
+			wantRoute: &route{
+				vcs:       vcs.Git,
+				cloneURL:  "https://github.com/A/MyRepo",
+				uri:       "github.com/a/myrepo",
+				action:    singleFileAction,
+				extraPath: "/v/master/foo",
+			},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/git/https/example.com/a/../../../etc.git",
+			wantErr: &httpError{"repo path must not contain ..", http.StatusBadRequest},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/2/git/https/example.com/a/%2e%2e/info/refs",
+			wantErr: &httpError{"path contains invalid characters", http.StatusBadRequest},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/git/https/example.com/.git/-",
+			wantErr: &httpError{"empty repo path", http.StatusNotFound},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/git/https/example.com:8443/myrepo.git",
+			wantErr: &httpError{"access to specified host is not allowed", http.StatusForbidden},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/git/git/example.com/a/myrepo/v/mybranch/myfile.txt",
+			wantErr: &httpError{"repo path must end in .git or be followed by /-/", http.StatusNotFound},
+		},
+		{
+			hosts:   []string{"example.com"},
+			path:    "/git/git/other.com/myrepo.git",
+			wantErr: &httpError{"access to specified host is not allowed", http.StatusForbidden},
+		},
 	}
 
 	for _, test := range tests {
-		route, err := router(test.hosts, test.path)
+		route, err := router(HostsPolicy(test.hosts), test.path)
 		if !reflect.DeepEqual(test.wantErr, err) {
 			t.Errorf("%s: want err %v, got %v", test.path, test.wantErr, err)
 			continue
@@ -82,3 +234,34 @@ func TestBisectBeforeNth(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitRepoPath(t *testing.T) {
+	tests := []struct {
+		p                       string
+		wantRepoPath, wantExtra string
+		wantOK                  bool
+	}{
+		{p: "a/b.git", wantRepoPath: "a/b.git", wantOK: true},
+		{p: "a/b.git/info/refs", wantRepoPath: "a/b.git", wantExtra: "/info/refs", wantOK: true},
+		{p: "a/b/-", wantRepoPath: "a/b", wantOK: true},
+		{p: "a/b/-/v/master/c", wantRepoPath: "a/b", wantExtra: "/v/master/c", wantOK: true},
+		{p: "a.git/b/-/v/master/c", wantRepoPath: "a.git", wantExtra: "/b/-/v/master/c", wantOK: true},
+		{p: "a/b.git/v/master/c/-/d", wantRepoPath: "a/b.git", wantExtra: "/v/master/c/-/d", wantOK: true},
+		{p: "a/b/v/master/c", wantOK: false},
+		{p: "-/a", wantOK: false},
+	}
+
+	for _, test := range tests {
+		repoPath, extra, ok := splitRepoPath(test.p)
+		if ok != test.wantOK {
+			t.Errorf("%s: want ok %v, got %v", test.p, test.wantOK, ok)
+			continue
+		}
+		if repoPath != test.wantRepoPath {
+			t.Errorf("%s: want repoPath %q, got %q", test.p, test.wantRepoPath, repoPath)
+		}
+		if extra != test.wantExtra {
+			t.Errorf("%s: want extraPath %q, got %q", test.p, test.wantExtra, extra)
+		}
+	}
+}
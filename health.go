@@ -0,0 +1,233 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// readinessCacheTTL is how long the result of the readiness checks is reused
+// for, so that frequent probes don't run them (which starts processes) each
+// time.
+const readinessCacheTTL = 5 * time.Second
+
+// defaultMinFreeSpace is the default for Config.MinFreeSpace.
+const defaultMinFreeSpace = 1 << 30
+
+// Health check statuses, from best to worst.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded" // some features are unavailable
+	healthFailed   = "failed"   // requests can't be served
+)
+
+// HealthCheck is the result of checking one of the server's dependencies.
+type HealthCheck struct {
+	Name    string
+	Status  string
+	Message string `json:",omitempty"`
+	Version string `json:",omitempty"`
+
+	// detail describes a problem in more detail than Message (e.g., with
+	// file paths, which aren't exposed to unauthenticated clients). It is
+	// logged.
+	detail string
+}
+
+// HealthResponse is the response to a health or readiness request. Its Status
+// is the worst status of its Checks.
+type HealthResponse struct {
+	Status string
+	Checks []*HealthCheck `json:",omitempty"`
+}
+
+type cachedReadiness struct {
+	key  readinessKey
+	resp *HealthResponse
+	time time.Time
+}
+
+// readinessKey holds the settings that checkHealth uses. A cached readiness
+// result is only reused while they are unchanged. (The Config itself can't be
+// compared, since Handler.Config returns a new one for each request unless
+// SetConfig was called.)
+type readinessKey struct {
+	storageDir     string
+	gitBinary      string
+	gitHTTPBackend string
+	hgBinary       string
+	python         string
+	minFreeSpace   int64
+}
+
+func (c *Config) readinessKey() readinessKey {
+	return readinessKey{
+		storageDir:     c.StorageDir,
+		gitBinary:      c.GitBinary,
+		gitHTTPBackend: c.GitHTTPBackend,
+		hgBinary:       c.HgBinary,
+		python:         c.Python27,
+		minFreeSpace:   c.MinFreeSpace,
+	}
+}
+
+// serveHealth handles requests for /healthz and /readyz. /healthz (a liveness
+// probe) always responds with HTTP 200 OK, without checking anything. /readyz
+// (a readiness probe) reports the status of the server's dependencies, and
+// responds with HTTP 503 Service Unavailable if any check failed.
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request, conf *Config) {
+	resp := &HealthResponse{Status: healthOK}
+	if r.URL.Path == readyzPath {
+		resp = h.checkReadiness(conf)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setNoCacheHeaders(w)
+	if resp.Status == healthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.logger().Error("failed to write health response", "err", err)
+	}
+}
+
+// checkReadiness returns the result of conf.checkHealth, which is cached for
+// readinessCacheTTL (or until the settings that it checks change). Problems
+// are logged when they are found.
+func (h *Handler) checkReadiness(conf *Config) *HealthResponse {
+	h.readinessLock.Lock()
+	defer h.readinessLock.Unlock()
+	key := conf.readinessKey()
+	if c := h.readiness; c != nil && c.key == key && time.Since(c.time) < readinessCacheTTL {
+		return c.resp
+	}
+	resp := conf.checkHealth()
+	for _, check := range resp.Checks {
+		if check.Status != healthOK {
+			h.logger().Warn("health check", "check", check.Name, "status", check.Status, "message", check.Message, "detail", check.detail)
+		}
+	}
+	h.readiness = &cachedReadiness{key: key, resp: resp, time: time.Now()}
+	return resp
+}
+
+// checkHealth checks that the storage directory is writable and has enough
+// free space, and that the executables used to serve repositories are present.
+func (c *Config) checkHealth() *HealthResponse {
+	// Serving git repositories needs git; serving hg repositories needs hg,
+	// or else Python 2.7 (with Mercurial).
+	hgRequired := healthDegraded
+	pythonRequired := healthOK
+	if c.HgBinary == "" {
+		pythonRequired = healthDegraded
+	}
+
+	resp := &HealthResponse{Status: healthOK}
+	for _, check := range []*HealthCheck{
+		c.checkStorage(),
+		c.checkFreeSpace(),
+		checkExecutable("git", c.GitBinary, healthFailed, "--version"),
+		checkExecutable("git-http-backend", c.GitHTTPBackend, healthDegraded),
+		checkExecutable("hg", c.HgBinary, hgRequired, "--version", "--quiet"),
+		checkExecutable("python", c.Python27, pythonRequired, "--version"),
+	} {
+		resp.Checks = append(resp.Checks, check)
+		if healthRank(check.Status) > healthRank(resp.Status) {
+			resp.Status = check.Status
+		}
+	}
+	return resp
+}
+
+func healthRank(status string) int {
+	switch status {
+	case healthOK:
+		return 0
+	case healthDegraded:
+		return 1
+	}
+	return 2
+}
+
+// checkStorage checks that files can be created in the storage directory.
+func (c *Config) checkStorage() *HealthCheck {
+	check := &HealthCheck{Name: "storage", Status: healthOK}
+	if err := os.MkdirAll(c.StorageDir, 0700); err != nil {
+		check.Status, check.Message, check.detail = healthFailed, "unable to create storage directory: "+pathErrorReason(err), err.Error()
+		return check
+	}
+	f, err := ioutil.TempFile(c.StorageDir, ".healthz-")
+	if err != nil {
+		check.Status, check.Message, check.detail = healthFailed, "unable to create file in storage directory: "+pathErrorReason(err), err.Error()
+		return check
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return check
+}
+
+// checkFreeSpace checks that the storage directory's file system has at least
+// MinFreeSpace bytes free.
+func (c *Config) checkFreeSpace() *HealthCheck {
+	check := &HealthCheck{Name: "disk", Status: healthOK}
+	free, err := freeSpace(c.StorageDir)
+	if err != nil {
+		check.Status, check.Message, check.detail = healthDegraded, "unable to determine free space: "+pathErrorReason(err), err.Error()
+		return check
+	}
+	min := c.MinFreeSpace
+	if min == 0 {
+		min = defaultMinFreeSpace
+	}
+	check.Message = fmt.Sprintf("%d bytes free", free)
+	if free < uint64(min) {
+		check.Status = healthDegraded
+		check.Message += fmt.Sprintf(" (less than %d)", min)
+	}
+	return check
+}
+
+// checkExecutable checks that the executable at path is present and, if
+// versionArgs are given, reports the first line of its output when run with
+// them. If it is missing or fails, the check's status is failStatus.
+func checkExecutable(name, path, failStatus string, versionArgs ...string) *HealthCheck {
+	check := &HealthCheck{Name: name, Status: healthOK}
+	if path == "" {
+		check.Status, check.Message = failStatus, "not configured"
+		return check
+	}
+	full, err := exec.LookPath(path)
+	if err != nil {
+		check.Status, check.Message, check.detail = failStatus, "not found", err.Error()
+		return check
+	}
+	if len(versionArgs) == 0 {
+		return check
+	}
+	// Python 2 prints its version to stderr.
+	out, err := exec.Command(full, versionArgs...).CombinedOutput()
+	if err != nil {
+		check.Status, check.Message, check.detail = failStatus, "failed to run", fmt.Sprintf("%s: %s", err, strings.TrimSpace(string(out)))
+		return check
+	}
+	check.Version = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	return check
+}
+
+// pathErrorReason returns the reason for err without the path that it
+// concerns, if it is an *os.PathError.
+func pathErrorReason(err error) string {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!openbsd
+
+package vcsserver
+
+import "errors"
+
+// freeSpace is not implemented on this platform.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package vcsserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	h := New(nil)
+	defer h.Close()
+
+	get := func(path string) (int, *HealthResponse) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var resp HealthResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %s: %q", path, err, rr.Body.String())
+		}
+		return rr.Code, &resp
+	}
+	checkStatus := func(resp *HealthResponse, name, want string) {
+		for _, c := range resp.Checks {
+			if c.Name == name {
+				if c.Status != want {
+					t.Errorf("check %s: got status %q (%s), want %q", name, c.Status, c.Message, want)
+				}
+				return
+			}
+		}
+		t.Errorf("no check %s", name)
+	}
+
+	// hg and Python may or may not be installed, so only the storage, disk
+	// and git checks are deterministic.
+	h.SetConfig(&Config{StorageDir: tmpdir, GitBinary: GitBinary, MinFreeSpace: 1})
+	code, resp := get("/readyz")
+	if code != http.StatusOK {
+		t.Errorf("/readyz: got %d, want 200", code)
+	}
+	checkStatus(resp, "storage", healthOK)
+	checkStatus(resp, "disk", healthOK)
+	checkStatus(resp, "git", healthOK)
+	if resp.Status == healthFailed {
+		t.Errorf("got status %q, want ok or degraded", resp.Status)
+	}
+
+	// Requiring more free space than any disk has degrades the server.
+	h.SetConfig(&Config{StorageDir: tmpdir, GitBinary: GitBinary, MinFreeSpace: 1 << 62})
+	_, resp = get("/readyz")
+	checkStatus(resp, "disk", healthDegraded)
+
+	// Without git or a writable storage directory, the server is not ready
+	// but is still alive.
+	notDir := filepath.Join(tmpdir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	h.SetConfig(&Config{StorageDir: notDir, GitBinary: filepath.Join(tmpdir, "no-git")})
+	code, resp = get("/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz: got %d, want 503", code)
+	}
+	if resp.Status != healthFailed {
+		t.Errorf("got status %q, want %q", resp.Status, healthFailed)
+	}
+	checkStatus(resp, "storage", healthFailed)
+	checkStatus(resp, "git", healthFailed)
+	for _, c := range resp.Checks {
+		if strings.Contains(c.Message, tmpdir) {
+			t.Errorf("check %s: message %q contains a path", c.Name, c.Message)
+		}
+	}
+	if code, resp := get("/healthz"); code != http.StatusOK || resp.Status != healthOK || len(resp.Checks) != 0 {
+		t.Errorf("/healthz: got %d %+v, want 200 with no checks", code, resp)
+	}
+
+	// Readiness is cached until the checked settings change, even if the
+	// Config is replaced by an equivalent one.
+	if err := os.Remove(notDir); err != nil {
+		t.Fatal(err)
+	}
+	_, resp = get("/readyz")
+	checkStatus(resp, "storage", healthFailed)
+	conf := *h.Config()
+	h.SetConfig(&conf)
+	_, resp = get("/readyz")
+	checkStatus(resp, "storage", healthFailed)
+	conf.MinFreeSpace = 1
+	h.SetConfig(&conf)
+	_, resp = get("/readyz")
+	checkStatus(resp, "storage", healthOK)
+}
+
+func TestHealth_CacheDefaultConfig(t *testing.T) {
+	h := New(nil)
+	defer h.Close()
+
+	// Without SetConfig, h.Config returns a new Config for each request, but
+	// the readiness checks are still only run once.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/readyz", nil))
+	first := h.readiness
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/readyz", nil))
+	if first == nil || h.readiness != first {
+		t.Error("readiness checks were run again, want cached result")
+	}
+}
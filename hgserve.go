@@ -0,0 +1,280 @@
+package vcsserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// HgBinary is the path to the hg executable, which is used to serve hg
+// repositories with a persistent `hg serve` process per repository. It is the
+// default for Config.HgBinary. If empty, hg repositories are served by running
+// hgweb with Python27 for each request.
+var HgBinary = os.Getenv("HG")
+
+func init() {
+	if HgBinary == "" {
+		HgBinary, _ = exec.LookPath("hg")
+	}
+}
+
+// HgServeIdleTimeout is the duration after which an idle `hg serve` process
+// is stopped.
+var HgServeIdleTimeout = 5 * time.Minute
+
+// hgServerPool is a pool of persistent `hg serve` processes, one per
+// repository, that serve hg's HTTP protocol.
+type hgServerPool struct {
+	logger func() *Logger // logger for the processes' output
+
+	mu      sync.Mutex
+	servers map[string]*hgServer // repo dir -> server
+
+	reaping bool
+	done    chan struct{} // closed by closeAll to stop the reaper
+	closed  bool
+}
+
+type hgServer struct {
+	// ready is closed when the process has started (and url, cmd and exited
+	// are set) or failed to start (and err is set).
+	ready chan struct{}
+	err   error
+
+	url      *url.URL
+	cmd      *exec.Cmd
+	exited   chan struct{} // closed when the process exits
+	lastUsed time.Time     // when the last request started or finished
+	inFlight int           // number of requests being proxied
+}
+
+func newHgServerPool(logger func() *Logger) *hgServerPool {
+	return &hgServerPool{logger: logger, servers: make(map[string]*hgServer), done: make(chan struct{})}
+}
+
+// serveHTTP proxies r to the `hg serve` process for the repository at dir,
+// starting it if needed.
+func (p *hgServerPool) serveHTTP(w http.ResponseWriter, r *http.Request, hgBinary, dir string) *httpError {
+	s, err := p.get(hgBinary, dir)
+	if err != nil {
+		requestLogger(r).Error("failed to start hg server", "err", err)
+		return &httpError{"failed to start hg server", http.StatusInternalServerError}
+	}
+	defer p.release(s)
+	httputil.NewSingleHostReverseProxy(s.url).ServeHTTP(w, r)
+	return nil
+}
+
+// release records that a request to s (returned by get) has finished.
+func (p *hgServerPool) release(s *hgServer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.inFlight--
+	s.lastUsed = time.Now()
+}
+
+// get returns a running `hg serve` process for the repository at dir,
+// starting one if there is none. The caller must call p.release when it has
+// finished using the process. The process is started without holding p.mu,
+// so that requests for other repositories aren't blocked while it starts;
+// concurrent callers for the same dir wait for the same process.
+func (p *hgServerPool) get(hgBinary, dir string) (*hgServer, error) {
+	p.mu.Lock()
+	if s, present := p.servers[dir]; present {
+		if !s.isReady() {
+			p.mu.Unlock()
+			<-s.ready
+			if s.err != nil {
+				return nil, s.err
+			}
+			p.mu.Lock()
+			s.inFlight++
+			p.mu.Unlock()
+			return s, nil
+		}
+		select {
+		case <-s.exited:
+			delete(p.servers, dir)
+		default:
+			s.inFlight++
+			s.lastUsed = time.Now()
+			p.mu.Unlock()
+			return s, nil
+		}
+	}
+	s := &hgServer{ready: make(chan struct{})}
+	p.servers[dir] = s
+	p.mu.Unlock()
+
+	started, err := startHgServer(hgBinary, dir, p.logger())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		s.err = err
+		if p.servers[dir] == s {
+			delete(p.servers, dir)
+		}
+		close(s.ready)
+		return nil, err
+	}
+	s.url, s.cmd, s.exited, s.lastUsed = started.url, started.cmd, started.exited, time.Now()
+	if p.servers[dir] != s {
+		// Stopped (e.g., by closeAll) while starting.
+		s.stop()
+		s.err = errors.New("hg server for " + dir + " was stopped while starting")
+		close(s.ready)
+		return nil, s.err
+	}
+	s.inFlight++
+	close(s.ready)
+	if !p.reaping && !p.closed {
+		p.reaping = true
+		go p.reap()
+	}
+	return s, nil
+}
+
+// isReady reports whether s has started or failed to start.
+func (s *hgServer) isReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// reap periodically stops `hg serve` processes that have had no requests in
+// flight for longer than HgServeIdleTimeout, until closeAll is called.
+func (p *hgServerPool) reap() {
+	t := time.NewTicker(HgServeIdleTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		for dir, s := range p.servers {
+			if s.isReady() && s.inFlight == 0 && time.Since(s.lastUsed) > HgServeIdleTimeout {
+				s.stop()
+				delete(p.servers, dir)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// stop stops the `hg serve` process for the repository at dir, if any.
+func (p *hgServerPool) stop(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, present := p.servers[dir]; present {
+		if s.isReady() {
+			s.stop()
+		}
+		delete(p.servers, dir)
+	}
+}
+
+// closeAll stops all `hg serve` processes and the reaper.
+func (p *hgServerPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	for dir, s := range p.servers {
+		if s.isReady() {
+			s.stop()
+		}
+		delete(p.servers, dir)
+	}
+}
+
+// hgServeStartTimeout is how long to wait for `hg serve` to start listening.
+const hgServeStartTimeout = 10 * time.Second
+
+// startHgServer starts `hg serve` for the repository at dir on a port chosen
+// by the OS and waits until it is listening. The process's output is logged
+// to log.
+func startHgServer(hgBinary, dir string, log *Logger) (*hgServer, error) {
+	log = log.With("dir", dir)
+	stdout := &hgServeStdout{log: log, addr: make(chan string, 1)}
+	cmd := exec.Command(hgBinary, "serve", "-R", dir, "--address", "127.0.0.1", "--port", "0", "--accesslog", os.DevNull)
+	cmd.Env = append(os.Environ(), "HGPLAIN=1", "LC_ALL=C")
+	cmd.Stdout = stdout
+	cmd.Stderr = log.StdLogger(LevelWarn, "hg serve").Writer()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &hgServer{
+		cmd:      cmd,
+		exited:   make(chan struct{}),
+		lastUsed: time.Now(),
+	}
+	go func() {
+		cmd.Wait()
+		close(s.exited)
+	}()
+
+	select {
+	case addr := <-stdout.addr:
+		s.url = &url.URL{Scheme: "http", Host: addr}
+		return s, nil
+	case <-s.exited:
+		return nil, errors.New("hg serve exited before listening for " + dir)
+	case <-time.After(hgServeStartTimeout):
+		s.stop()
+		return nil, fmt.Errorf("timed out waiting for hg serve for %s", dir)
+	}
+}
+
+func (s *hgServer) stop() {
+	s.cmd.Process.Kill()
+	<-s.exited
+}
+
+// hgServeListeningPattern matches the line that `hg serve` (with LC_ALL=C)
+// prints when it is listening, e.g., "listening at http://127.0.0.1:1234/
+// (bound to 127.0.0.1:1234)".
+var hgServeListeningPattern = regexp.MustCompile(`\(bound to (.*):(\d+)\)`)
+
+// hgServeStdout receives the standard output of `hg serve`. It sends the
+// address that the process listens on to addr, and logs other output.
+type hgServeStdout struct {
+	log  *Logger
+	addr chan string
+	sent bool
+	buf  []byte
+}
+
+func (w *hgServeStdout) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if m := hgServeListeningPattern.FindStringSubmatch(line); m != nil && !w.sent {
+			w.sent = true
+			w.addr <- net.JoinHostPort(m[1], m[2])
+			continue
+		}
+		w.log.Debug("hg serve", "output", line)
+	}
+}
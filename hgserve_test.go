@@ -0,0 +1,163 @@
+package vcsserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHgServerPool(t *testing.T) {
+	if HgBinary == "" {
+		t.Skip("hg not found")
+	}
+
+	tmpdir, err := ioutil.TempDir("", "vcsserver-hgserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "repo")
+	cmd := exec.Command("sh", "-c", `
+set -e
+hg init repo
+cd repo
+echo 'Hello, foo' > foo
+hg add -q foo
+hg commit -q -u a -m init
+`)
+	cmd.Dir = tmpdir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("creating hg repo: %s (output: %s)", err, out)
+	}
+
+	pool := newHgServerPool(func() *Logger { return defaultLogger })
+	defer pool.closeAll()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := pool.serveHTTP(w, r, HgBinary, dir); err != nil {
+			http.Error(w, err.message, err.statusCode)
+		}
+	}))
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		localRepoDir := filepath.Join(tmpdir, "clone"+strconv.Itoa(i))
+		if out, err := exec.Command(HgBinary, "clone", "-q", s.URL, localRepoDir).CombinedOutput(); err != nil {
+			t.Fatalf("hg clone: %s (output: %s)", err, out)
+		}
+		if f := filepath.Join(localRepoDir, "foo"); !isFile(f) {
+			t.Errorf("want file %s to exist", f)
+		}
+	}
+
+	// Both clones should have been served by the same process.
+	if n := len(pool.servers); n != 1 {
+		t.Errorf("want 1 hg server, got %d", n)
+	}
+}
+
+func TestHgServerPool_StartFailure(t *testing.T) {
+	hgBinary, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false not found")
+	}
+
+	pool := newHgServerPool(func() *Logger { return defaultLogger })
+	defer pool.closeAll()
+
+	// Concurrent requests for a repository whose server fails to start all
+	// get the error, and the failed server is not kept.
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := pool.get(hgBinary, "/nonexistent")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err == nil {
+			t.Error("want error starting hg server")
+		}
+	}
+	if n := len(pool.servers); n != 0 {
+		t.Errorf("want 0 hg servers, got %d", n)
+	}
+}
+
+func TestHgServerPool_Reap(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	defer func(d time.Duration) { HgServeIdleTimeout = d }(HgServeIdleTimeout)
+	HgServeIdleTimeout = 20 * time.Millisecond
+
+	// Add a server (standing in for `hg serve`) with a request in flight.
+	pool := newHgServerPool(func() *Logger { return defaultLogger })
+	defer pool.closeAll()
+	cmd := exec.Command(sleep, "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &hgServer{ready: make(chan struct{}), cmd: cmd, exited: make(chan struct{}), lastUsed: time.Now(), inFlight: 1}
+	close(s.ready)
+	go func() {
+		cmd.Wait()
+		close(s.exited)
+	}()
+	pool.servers["repo"] = s
+	pool.reaping = true
+	go pool.reap()
+
+	serverCount := func() int {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.servers)
+	}
+
+	time.Sleep(5 * HgServeIdleTimeout)
+	if n := serverCount(); n != 1 {
+		t.Fatalf("server with a request in flight was reaped")
+	}
+
+	pool.release(s)
+	for i := 0; serverCount() != 0; i++ {
+		if i == 100 {
+			t.Fatal("idle server was not reaped")
+		}
+		time.Sleep(HgServeIdleTimeout)
+	}
+	select {
+	case <-s.exited:
+	default:
+		t.Error("reaped server's process was not stopped")
+	}
+}
+
+func TestHgServeStdout(t *testing.T) {
+	var buf bytes.Buffer
+	w := &hgServeStdout{log: NewLogger(&buf, LevelDebug, false), addr: make(chan string, 1)}
+	for _, s := range []string{"listening at http://127.0.0.1:4", "1234/ (bound to 127.0.0.1:41234)\nother", " output\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case addr := <-w.addr:
+		if want := "127.0.0.1:41234"; addr != want {
+			t.Errorf("got addr %q, want %q", addr, want)
+		}
+	default:
+		t.Fatal("got no addr")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`output="other output"`)) {
+		t.Errorf("other output was not logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,215 @@
+package vcsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hooksPathPrefix is the prefix of the paths at which push notifications from
+// upstream hosts are received (e.g., /hooks/github).
+const hooksPathPrefix = "/hooks/"
+
+// maxHookPayload is the maximum size of a push notification's body (GitHub's
+// limit).
+const maxHookPayload = 25 << 20
+
+// hookEvent is a notification from an upstream host, parsed by a
+// hookProvider.
+type hookEvent struct {
+	push bool // whether the event is a push (other events are ignored)
+
+	vcs     string // "git" or "hg"
+	repoURL string // URL of the pushed repository (e.g., https://github.com/user/repo)
+}
+
+// A hookProvider verifies and parses notifications from an upstream host.
+type hookProvider func(r *http.Request, body []byte, secret string) (*hookEvent, *httpError)
+
+var hookProviders = map[string]hookProvider{
+	"github":    githubHook,
+	"gitlab":    gitlabHook,
+	"bitbucket": bitbucketHook,
+}
+
+// serveHook handles a push notification from the upstream host provider
+// (e.g., "github") by updating the mirror of the pushed repository, if there
+// is one. The update runs in the background (and is coalesced with other
+// clones and updates of the mirror), so the notification is acknowledged
+// immediately.
+func (h *Handler) serveHook(w http.ResponseWriter, r *http.Request, conf *Config, provider string) *httpError {
+	parse, ok := hookProviders[provider]
+	secret := conf.HookSecrets[provider]
+	if !ok || secret == "" {
+		return &httpError{"no webhook is configured for " + provider, http.StatusNotFound}
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return &httpError{"method not allowed", http.StatusMethodNotAllowed}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookPayload+1))
+	if err != nil {
+		return &httpError{"error reading request body", http.StatusBadRequest}
+	}
+	if len(body) > maxHookPayload {
+		return &httpError{"payload too large", http.StatusRequestEntityTooLarge}
+	}
+	ev, herr := parse(r, body, secret)
+	if herr != nil {
+		return herr
+	}
+	if !ev.push {
+		fmt.Fprintln(w, "ignored event")
+		return nil
+	}
+
+	route, herr := hookRoute(conf, ev)
+	if herr != nil {
+		return herr
+	}
+	dir := conf.repoDir(route.vcs, route.uri)
+	l := requestLogger(r).With("repo", route.uri)
+	if conf.Offline || !isMirrorDir(route.vcs.ShortName(), dir) {
+		l.Debug("ignoring push notification for repository that is not mirrored")
+		fmt.Fprintln(w, "repository is not mirrored")
+		return nil
+	}
+
+	// Update using the clone URL that the mirror was requested with (e.g.,
+	// an ssh:// URL), if it is known.
+	cloneURL := route.cloneURL
+	if s := h.mirrorState(dir); s.cloneURL != "" {
+		cloneURL = s.cloneURL
+	}
+	ctx := detachSpan(r.Context())
+	go func() {
+		if err := h.cloneOrUpdate(ctx, conf, route.vcs, dir, cloneURL, true); err != nil {
+			l.Warn("update after push notification failed", "err", err.message)
+		}
+	}()
+	l.Info("updating mirror after push notification", "provider", provider)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "updating mirror")
+	return nil
+}
+
+// hookRoute returns the route of the repository in ev, as if it were
+// requested by a client. The repository must be allowed by the access policy.
+func hookRoute(conf *Config, ev *hookEvent) (*route, *httpError) {
+	u, err := url.Parse(ev.repoURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, &httpError{"bad repository URL in payload", http.StatusBadRequest}
+	}
+	p := strings.Trim(u.Path, "/")
+	if p == "" {
+		return nil, &httpError{"bad repository URL in payload", http.StatusBadRequest}
+	}
+	return router(&conf.AccessPolicy, "/"+ev.vcs+"/"+u.Scheme+"/"+u.Host+"/"+p+"/"+repoPathSeparator)
+}
+
+// verifyHMAC checks that signature (of the form "sha256=<hex>") is the
+// HMAC-SHA256 of body with secret.
+func verifyHMAC(signature string, body []byte, secret string) *httpError {
+	const prefix = "sha256="
+	if !strings.HasPrefix(signature, prefix) {
+		return &httpError{"missing or unsupported signature", http.StatusUnauthorized}
+	}
+	got, err := hex.DecodeString(signature[len(prefix):])
+	if err != nil {
+		return &httpError{"malformed signature", http.StatusUnauthorized}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return &httpError{"invalid signature", http.StatusUnauthorized}
+	}
+	return nil
+}
+
+func decodeHookPayload(body []byte, v interface{}) *httpError {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &httpError{"malformed payload: " + err.Error(), http.StatusBadRequest}
+	}
+	return nil
+}
+
+// githubHook parses a GitHub webhook delivery, which is signed with the
+// secret in the X-Hub-Signature-256 header.
+func githubHook(r *http.Request, body []byte, secret string) (*hookEvent, *httpError) {
+	if err := verifyHMAC(r.Header.Get("X-Hub-Signature-256"), body, secret); err != nil {
+		return nil, err
+	}
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		return &hookEvent{}, nil
+	}
+	var payload struct {
+		Repository struct {
+			HTMLURL string `json:"html_url"`
+		} `json:"repository"`
+	}
+	if err := decodeHookPayload(body, &payload); err != nil {
+		return nil, err
+	}
+	return &hookEvent{push: true, vcs: "git", repoURL: payload.Repository.HTMLURL}, nil
+}
+
+// gitlabHook parses a GitLab webhook delivery, which contains the secret in
+// the X-Gitlab-Token header.
+func gitlabHook(r *http.Request, body []byte, secret string) (*hookEvent, *httpError) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+		return nil, &httpError{"invalid token", http.StatusUnauthorized}
+	}
+	if ev := r.Header.Get("X-Gitlab-Event"); ev != "Push Hook" && ev != "Tag Push Hook" {
+		return &hookEvent{}, nil
+	}
+	var payload struct {
+		Project struct {
+			WebURL string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := decodeHookPayload(body, &payload); err != nil {
+		return nil, err
+	}
+	return &hookEvent{push: true, vcs: "git", repoURL: payload.Project.WebURL}, nil
+}
+
+// bitbucketHook parses a Bitbucket Cloud webhook delivery, which is signed
+// with the secret in the X-Hub-Signature header.
+func bitbucketHook(r *http.Request, body []byte, secret string) (*hookEvent, *httpError) {
+	if err := verifyHMAC(r.Header.Get("X-Hub-Signature"), body, secret); err != nil {
+		return nil, err
+	}
+	if r.Header.Get("X-Event-Key") != "repo:push" {
+		return &hookEvent{}, nil
+	}
+	var payload struct {
+		Repository struct {
+			SCM   string `json:"scm"`
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+	}
+	if err := decodeHookPayload(body, &payload); err != nil {
+		return nil, err
+	}
+	vcsName := payload.Repository.SCM
+	if vcsName == "" {
+		vcsName = "git"
+	}
+	if vcsName != "git" && vcsName != "hg" {
+		return nil, &httpError{"unsupported repository type in payload", http.StatusBadRequest}
+	}
+	return &hookEvent{push: true, vcs: vcsName, repoURL: payload.Repository.Links.HTML.Href}, nil
+}
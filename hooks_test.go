@@ -0,0 +1,130 @@
+package vcsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hmacSignature(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHooks(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Store a mirror of https://example.com/user/repo.
+	hostDir := filepath.Join(tmpdir, "git", "example.com", "user")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(makeGitRepo(t, hostDir), filepath.Join(hostDir, "repo")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(nil)
+	defer h.Close()
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		GitBinary:    GitBinary,
+		HookSecrets:  map[string]string{"github": "s3cret", "gitlab": "t0ken", "bitbucket": "s3cret"},
+	})
+
+	const (
+		githubPush    = `{"repository": {"html_url": "https://example.com/user/repo"}}`
+		gitlabPush    = `{"project": {"web_url": "https://example.com/user/repo"}}`
+		bitbucketPush = `{"repository": {"scm": "git", "links": {"html": {"href": "https://example.com/user/repo"}}}}`
+	)
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		header      map[string]string
+		wantCode    int
+		wantUpdates float64
+	}{
+		{"github push", "/hooks/github", githubPush, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": hmacSignature(githubPush, "s3cret")}, http.StatusAccepted, 1},
+		{"github bad signature", "/hooks/github", githubPush, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": hmacSignature(githubPush, "wrong")}, http.StatusUnauthorized, 0},
+		{"github unsigned", "/hooks/github", githubPush, map[string]string{"X-GitHub-Event": "push"}, http.StatusUnauthorized, 0},
+		{"github ping", "/hooks/github", `{}`, map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": hmacSignature(`{}`, "s3cret")}, http.StatusOK, 0},
+		{"gitlab push", "/hooks/gitlab", gitlabPush, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "t0ken"}, http.StatusAccepted, 1},
+		{"gitlab bad token", "/hooks/gitlab", gitlabPush, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, http.StatusUnauthorized, 0},
+		{"bitbucket push", "/hooks/bitbucket", bitbucketPush, map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": hmacSignature(bitbucketPush, "s3cret")}, http.StatusAccepted, 1},
+		{"unconfigured provider", "/hooks/other", githubPush, nil, http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		pre := h.metrics.mirrorOpCount("update", "example.com")
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != test.wantCode {
+			t.Errorf("%s: got %d, want %d: %s", test.name, rr.Code, test.wantCode, rr.Body)
+		}
+
+		// The update runs in the background. Wait for it to finish, so
+		// that it isn't coalesced with the next test's update.
+		var updates float64
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			updates = h.metrics.mirrorOpCount("update", "example.com") - pre
+			h.currentlyUpdatingLock.Lock()
+			updating := len(h.currentlyUpdating) > 0
+			h.currentlyUpdatingLock.Unlock()
+			if (updates >= test.wantUpdates && !updating) || time.Now().After(deadline) {
+				break
+			}
+		}
+		if updates != test.wantUpdates {
+			t.Errorf("%s: got %v updates, want %v", test.name, updates, test.wantUpdates)
+		}
+	}
+}
+
+func TestHookRoute(t *testing.T) {
+	conf := &Config{AccessPolicy: *HostsPolicy([]string{"example.com"})}
+	tests := []struct {
+		repoURL      string
+		wantURI      string
+		wantCloneURL string
+		wantCode     int
+	}{
+		{"https://example.com/user/repo", "example.com/user/repo", "https://example.com/user/repo", 0},
+		{"https://example.com/user/repo.git/", "example.com/user/repo", "https://example.com/user/repo.git", 0},
+		{"https://other.example.com/user/repo", "", "", http.StatusForbidden},
+		{"https://example.com/", "", "", http.StatusBadRequest},
+		{"ftp://example.com/user/repo", "", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		route, err := hookRoute(conf, &hookEvent{push: true, vcs: "git", repoURL: test.repoURL})
+		if test.wantCode != 0 {
+			if err == nil || err.statusCode != test.wantCode {
+				t.Errorf("%s: got error %v, want status %d", test.repoURL, err, test.wantCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.repoURL, err.message)
+			continue
+		}
+		if route.uri != test.wantURI || route.cloneURL != test.wantCloneURL {
+			t.Errorf("%s: got uri %q, clone URL %q", test.repoURL, route.uri, route.cloneURL)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package vcsserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLogLevel parses a log level name ("debug", "info", "warn" or "error").
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes leveled, structured log messages. Each message has a list of
+// key-value fields, which are written as key=value pairs or, in JSON mode, as
+// the fields of a JSON object. A Logger is safe for concurrent use.
+type Logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+type logSink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+// NewLogger returns a Logger that writes messages of at least the specified
+// level to w, in JSON if json is true.
+func NewLogger(w io.Writer, level LogLevel, json bool) *Logger {
+	return &Logger{sink: &logSink{w: w, level: level, json: json}}
+}
+
+// defaultLogger is used by Handlers whose Log is nil.
+var defaultLogger = NewLogger(os.Stderr, LevelInfo, false)
+
+// With returns a Logger that adds the key-value pairs in fields to every
+// message.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{sink: l.sink, fields: append(l.fields[:len(l.fields):len(l.fields)], fields...)}
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level LogLevel, msg string, fields []interface{}) {
+	if level < l.sink.level {
+		return
+	}
+	fields = append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var line []byte
+	if l.sink.json {
+		obj := map[string]interface{}{"time": now, "level": level.String(), "msg": msg}
+		for i := 0; i < len(fields); i += 2 {
+			key, value := fieldKeyValue(fields, i)
+			switch v := value.(type) {
+			case error:
+				value = v.Error()
+			case time.Duration:
+				value = v.String()
+			}
+			obj[key] = value
+		}
+		var err error
+		if line, err = json.Marshal(obj); err != nil {
+			line, _ = json.Marshal(map[string]interface{}{"time": now, "level": level.String(), "msg": msg, "logError": err.Error()})
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString(now)
+		b.WriteString(" ")
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteString(" ")
+		b.WriteString(msg)
+		for i := 0; i < len(fields); i += 2 {
+			key, value := fieldKeyValue(fields, i)
+			b.WriteString(" ")
+			b.WriteString(key)
+			b.WriteString("=")
+			b.WriteString(formatLogValue(value))
+		}
+		line = []byte(b.String())
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.w.Write(append(line, '\n'))
+}
+
+func fieldKeyValue(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 == len(fields) {
+		return key, "(missing)"
+	}
+	return key, fields[i+1]
+}
+
+// formatLogValue formats a field value for the text output mode, quoting it
+// if it is empty or contains spaces, quotes or control characters.
+func formatLogValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case time.Duration:
+		s = v.String()
+	case fmt.Stringer:
+		s = v.String()
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f }) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// StdLogger returns a *log.Logger that writes each line as a message at the
+// specified level, with the key-value pairs in fields (for APIs that require a
+// *log.Logger, such as the CGI handler's stderr logger).
+func (l *Logger) StdLogger(level LogLevel, msg string, fields ...interface{}) *log.Logger {
+	return log.New(&stdLogWriter{l: l.With(fields...), level: level, msg: msg}, "", 0)
+}
+
+type stdLogWriter struct {
+	l     *Logger
+	level LogLevel
+	msg   string
+}
+
+func (w *stdLogWriter) Write(p []byte) (int, error) {
+	w.l.log(w.level, w.msg, []interface{}{"output", strings.TrimRight(string(p), "\n")})
+	return len(p), nil
+}
+
+// logger returns h.Log, or the default logger if it is nil.
+func (h *Handler) logger() *Logger {
+	if h.Log != nil {
+		return h.Log
+	}
+	return defaultLogger
+}
+
+// requestIDHeader is the header that contains the ID of a request. Incoming
+// request IDs (e.g., from a load balancer) are used if they are valid.
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the valid request ID in r's header, or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 && strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r >= 0x7f }) == -1 {
+		return id
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of r whose context carries the request-scoped
+// logger l.
+func withLogger(r *http.Request, l *Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, l))
+}
+
+// requestLogger returns the request-scoped logger of r (which includes its
+// request ID), or the default logger if it has none.
+func requestLogger(r *http.Request) *Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// contextLogger returns the request-scoped logger carried by ctx (a request's
+// context, or one derived from it), or h's logger if it has none.
+func (h *Handler) contextLogger(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return h.logger()
+}
@@ -0,0 +1,124 @@
+package vcsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelInfo, false).With("requestID", "abc")
+	l.Debug("hidden")
+	l.Info("hello", "path", "/a b", "n", 3)
+	l.Error("failed", "err", errors.New("oops"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, got %q", buf.String())
+	}
+	for i, want := range []string{` INFO hello requestID=abc path="/a b" n=3`, ` ERROR failed requestID=abc err=oops`} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("want line %d to end with %q, got %q", i, want, lines[i])
+		}
+	}
+
+	buf.Reset()
+	NewLogger(&buf, LevelDebug, true).With("requestID", "abc").Debug("hello", "err", errors.New("oops"))
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatalf("Unmarshal %q: %s", buf.String(), err)
+	}
+	if obj["level"] != "debug" || obj["msg"] != "hello" || obj["requestID"] != "abc" || obj["err"] != "oops" || obj["time"] == nil {
+		t.Errorf("unexpected JSON log message %q", buf.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if level, err := ParseLogLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("want LevelWarn, got %v (error: %v)", level, err)
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("want error for unknown level, got nil")
+	}
+}
+
+func TestHandler_AccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := New([]string{"example.com"})
+	h.Log = NewLogger(&buf, LevelInfo, true)
+
+	// Incoming request IDs are used and returned.
+	r := httptest.NewRequest("GET", "/bad", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get(requestIDHeader); id != "req-1" {
+		t.Errorf("want request ID req-1, got %q", id)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Unmarshal %q: %s", buf.String(), err)
+	}
+	want := map[string]interface{}{"msg": "request", "requestID": "req-1", "method": "GET", "path": "/bad", "action": "none", "status": float64(404), "bytes": float64(len(w.Body.String()))}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("want access log %s == %v, got %v", k, v, entry[k])
+		}
+	}
+
+	// Invalid request IDs are replaced.
+	r = httptest.NewRequest("GET", "/bad", nil)
+	r.Header.Set(requestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get(requestIDHeader); len(id) != 32 {
+		t.Errorf("want new random request ID, got %q", id)
+	}
+}
+
+func TestHandler_CloneErrorLogRequestID(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var buf bytes.Buffer
+	h := New(nil)
+	defer h.Close()
+	h.Log = NewLogger(&buf, LevelInfo, true)
+	h.SetConfig(&Config{
+		StorageDir:   tmpdir,
+		GitBinary:    GitBinary,
+		AccessPolicy: *HostsPolicy([]string{"127.0.0.1:1"}),
+	})
+
+	// Cloning fails, since nothing listens on port 1.
+	r := httptest.NewRequest("GET", "/git/http/127.0.0.1:1/foo.git/info/refs?service=git-upload-pack", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Unmarshal %q: %s", line, err)
+		}
+		if entry["msg"] == "error cloning mirror" {
+			found = true
+			if entry["requestID"] != "req-1" {
+				t.Errorf("want clone error logged with request ID req-1, got %q", line)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("want clone error to be logged, got %q", buf.String())
+	}
+}
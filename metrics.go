@@ -0,0 +1,309 @@
+package vcsserver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsPath is the path at which a Handler serves its metrics.
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds (in seconds) of the buckets of the
+// duration histograms.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// storageUsageInterval is the minimum interval between computations of the
+// storage usage, which requires walking the storage directory.
+const storageUsageInterval = time.Minute
+
+// metrics records a Handler's metrics, which it serves in the Prometheus text
+// exposition format. It is safe for concurrent use.
+type metrics struct {
+	mu sync.Mutex
+
+	mirrorOps        counterVec   // op, host
+	mirrorOpFailures counterVec   // op, host
+	mirrorOpDuration histogramVec // op, host
+	requests         counterVec   // action, code
+	requestDuration  histogramVec // action
+	lockWait         histogramVec // lock
+
+	storageUsage     map[string]*storageUsage // by VCS
+	mirrorBytes      map[string]int64         // by mirror dir
+	storageUsageDir  string
+	storageUsageTime time.Time
+}
+
+type storageUsage struct {
+	bytes   int64
+	mirrors int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		mirrorOps:        counterVec{},
+		mirrorOpFailures: counterVec{},
+		mirrorOpDuration: histogramVec{},
+		requests:         counterVec{},
+		requestDuration:  histogramVec{},
+		lockWait:         histogramVec{},
+	}
+}
+
+// mirrorOp records a clone or update (op) of the repository at cloneURL that
+// took duration d, and whether it failed.
+func (m *metrics) mirrorOp(op, cloneURL string, d time.Duration, failed bool) {
+	host := cloneURL
+	if u, err := url.Parse(cloneURL); err == nil {
+		host = u.Host
+	}
+	labels := labelString("op", op, "host", host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mirrorOps[labels]++
+	if failed {
+		m.mirrorOpFailures[labels]++
+	}
+	m.mirrorOpDuration.observe(labels, d.Seconds())
+}
+
+// mirrorOpCount returns the number of op operations (clones or updates) on
+// repositories on host.
+func (m *metrics) mirrorOpCount(op, host string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mirrorOps[labelString("op", op, "host", host)]
+}
+
+// request records a request for action that took duration d and responded
+// with the HTTP status code.
+func (m *metrics) request(action action, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[labelString("action", string(action), "code", fmt.Sprint(code))]++
+	m.requestDuration.observe(labelString("action", string(action)), d.Seconds())
+}
+
+// lockWaited records that acquiring a lock (e.g., "repo" or "update") took
+// duration d.
+func (m *metrics) lockWaited(lock string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lockWait.observe(labelString("lock", lock), d.Seconds())
+}
+
+// updateStorageUsage computes the disk usage of the mirrors in storageDir,
+// unless it was already computed less than storageUsageInterval ago.
+func (m *metrics) updateStorageUsage(storageDir string) {
+	m.mu.Lock()
+	fresh := m.storageUsageDir == storageDir && time.Since(m.storageUsageTime) < storageUsageInterval
+	m.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	usage := make(map[string]*storageUsage)
+	mirrorBytes := make(map[string]int64)
+	for _, vcsName := range []string{"git", "hg"} {
+		u := &storageUsage{}
+		root := filepath.Join(storageDir, vcsName)
+		var mirror string // the mirror that contains path, if any
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if mirror != "" && !strings.HasPrefix(path, mirror+string(filepath.Separator)) {
+				mirror = ""
+			}
+			if fi.Mode().IsRegular() {
+				u.bytes += fi.Size()
+				if mirror != "" {
+					mirrorBytes[mirror] += fi.Size()
+				}
+			}
+			if mirror == "" && fi.IsDir() && path != root && isMirrorDir(vcsName, path) {
+				u.mirrors++
+				mirror = path
+				mirrorBytes[mirror] = 0
+			}
+			return nil
+		})
+		usage[vcsName] = u
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storageUsage, m.mirrorBytes, m.storageUsageDir, m.storageUsageTime = usage, mirrorBytes, storageDir, time.Now()
+}
+
+// mirrorSize returns the total size of the files of the mirror at dir in
+// storageDir, as of the last computation of the storage usage (which it
+// updates if it is stale). If the mirror didn't exist then, ok is false.
+func (m *metrics) mirrorSize(storageDir, dir string) (size int64, ok bool) {
+	m.updateStorageUsage(storageDir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size, ok = m.mirrorBytes[dir]
+	return size, ok
+}
+
+// isMirrorDir returns true if dir contains a mirror (a bare git repository or
+// an hg repository).
+func isMirrorDir(vcsName, dir string) bool {
+	switch vcsName {
+	case "git":
+		return isDir(filepath.Join(dir, "objects")) && isDir(filepath.Join(dir, "refs"))
+	case "hg":
+		return isDir(filepath.Join(dir, ".hg"))
+	}
+	return false
+}
+
+// writeTo writes the metrics to w in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mirrorOps.writeTo(w, "vcsserver_mirror_operations_total", "Number of mirror clones and updates.")
+	m.mirrorOpFailures.writeTo(w, "vcsserver_mirror_operation_failures_total", "Number of failed mirror clones and updates.")
+	m.mirrorOpDuration.writeTo(w, "vcsserver_mirror_operation_duration_seconds", "Duration of mirror clones and updates.")
+	m.requests.writeTo(w, "vcsserver_requests_total", "Number of requests by action and HTTP status code.")
+	m.requestDuration.writeTo(w, "vcsserver_request_duration_seconds", "Duration of requests by action.")
+	m.lockWait.writeTo(w, "vcsserver_lock_wait_seconds", "Time spent waiting to acquire repository locks.")
+
+	if m.storageUsage != nil {
+		bytes, mirrors := counterVec{}, counterVec{}
+		for vcsName, u := range m.storageUsage {
+			bytes[labelString("vcs", vcsName)] = float64(u.bytes)
+			mirrors[labelString("vcs", vcsName)] = float64(u.mirrors)
+		}
+		bytes.writeGauge(w, "vcsserver_storage_bytes", "Disk space used by mirrors.")
+		mirrors.writeGauge(w, "vcsserver_mirrors", "Number of stored mirrors.")
+	}
+}
+
+// serveMetrics handles requests for the metrics.
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request, conf *Config) {
+	h.metrics.updateStorageUsage(conf.StorageDir)
+	h.pruneMirrorStates()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.metrics.writeTo(w)
+}
+
+// counterVec maps label strings (see labelString) to values.
+type counterVec map[string]float64
+
+func (v counterVec) writeTo(w io.Writer, name, help string) {
+	v.write(w, name, help, "counter")
+}
+
+func (v counterVec) writeGauge(w io.Writer, name, help string) {
+	v.write(w, name, help, "gauge")
+}
+
+func (v counterVec) write(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, labels := range sortedKeys(v) {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(v[labels]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket in durationBuckets (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+// histogramVec maps label strings (see labelString) to histograms.
+type histogramVec map[string]*histogram
+
+func (v histogramVec) observe(labels string, value float64) {
+	h := v[labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		v[labels] = h
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v histogramVec) writeTo(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(v))
+	for labels := range v {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		h := v[labels]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(labels, labelString("le", formatFloat(bound)))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(labels, labelString("le", "+Inf"))), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+	}
+}
+
+// labelString returns the Prometheus label pairs for the alternating names
+// and values in nameValues (e.g., `op="clone",host="example.com"`).
+func labelString(nameValues ...string) string {
+	pairs := make([]string, 0, len(nameValues)/2)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		pairs = append(pairs, nameValues[i]+`="`+escapeLabelValue(nameValues[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+func sortedKeys(v counterVec) []string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,85 @@
+package vcsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Store a mirror of https://example.com/repo.git.
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	makeGitRepo(t, hostDir)
+	os.RemoveAll(filepath.Join(hostDir, "work"))
+
+	h := New(nil)
+	defer h.Close()
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+	})
+
+	h.metrics.mirrorOp("clone", "https://example.com/a.git", 2*time.Second, false)
+	h.metrics.mirrorOp("update", "https://example.com/a.git", 50*time.Millisecond, true)
+
+	for _, path := range []string{"/git/https/example.com/repo.git/api/blame/master/foo", "/bad"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want /metrics status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE vcsserver_requests_total counter\n",
+		`vcsserver_requests_total{action="fileBlame",code="200"} 1` + "\n",
+		`vcsserver_requests_total{action="none",code="404"} 1` + "\n",
+		`vcsserver_request_duration_seconds_count{action="fileBlame"} 1` + "\n",
+		`vcsserver_lock_wait_seconds_count{lock="repo"} 1` + "\n",
+		`vcsserver_mirror_operations_total{op="clone",host="example.com"} 1` + "\n",
+		`vcsserver_mirror_operation_failures_total{op="update",host="example.com"} 1` + "\n",
+		`vcsserver_mirror_operation_duration_seconds_bucket{op="clone",host="example.com",le="1"} 0` + "\n",
+		`vcsserver_mirror_operation_duration_seconds_bucket{op="clone",host="example.com",le="2.5"} 1` + "\n",
+		`vcsserver_mirror_operation_duration_seconds_bucket{op="clone",host="example.com",le="+Inf"} 1` + "\n",
+		`vcsserver_mirror_operation_duration_seconds_sum{op="clone",host="example.com"} 2` + "\n",
+		`vcsserver_mirrors{vcs="git"} 1` + "\n",
+		`vcsserver_mirrors{vcs="hg"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `vcsserver_storage_bytes{vcs="git"} 0`+"\n") {
+		t.Error("want nonzero git storage usage")
+	}
+	size, ok := h.metrics.mirrorSize(tmpdir, filepath.Join(hostDir, "repo.git"))
+	if want := fmt.Sprintf(`vcsserver_storage_bytes{vcs="git"} %d`+"\n", size); !ok || !strings.Contains(body, want) {
+		t.Errorf("got mirror size %d (%v), want it to be the git storage usage", size, ok)
+	}
+}
+
+func TestLabelString(t *testing.T) {
+	if got, want := labelString("a", "x", "b", `"y"\`+"\n"), `a="x",b="\"y\"\\\n"`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -4,34 +4,66 @@ import (
 	"bufio"
 	"github.com/sourcegraph/go-cgi/cgi"
 	"github.com/sourcegraph/go-vcs"
-	"log"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
 )
 
-func proxy(w http.ResponseWriter, r *http.Request, route *route, dir string) *httpError {
+func proxy(w http.ResponseWriter, r *http.Request, conf *Config, hgServers *hgServerPool, route *route, dir string) *httpError {
+	ctx, span := startSpan(r.Context(), "proxy")
+	defer span.Finish()
+
 	var backend *cgi.Handler
-	logger := log.New(os.Stderr, "proxy "+route.uri+": ", 0)
+	// CGI programs' stderr is logged with the request's ID.
+	logger := requestLogger(r).StdLogger(LevelWarn, "CGI stderr", "repo", route.uri)
+	rr := newRecorder(w)
 	switch route.vcs {
 	case vcs.Git:
-		r.URL.Path = "/" + route.uri + route.extraPath
+		// Serve fetches natively; fall back to git-http-backend for other
+		// requests (e.g., the dumb HTTP protocol).
+		if ok, err := serveGitSmartHTTP(rr, r, conf, dir, route.extraPath); ok {
+			span.SetAttribute("backend", "git upload-pack")
+			if err != nil {
+				span.SetError(err.message)
+			}
+			return err
+		}
+		span.SetAttribute("backend", "git-http-backend")
+		projectRoot := filepath.Join(conf.StorageDir, route.vcs.ShortName())
+		repoPath, err := filepath.Rel(projectRoot, dir)
+		if err != nil {
+			requestLogger(r).Error("failed to get repo path", "err", err)
+			return &httpError{"failed to get repo path", http.StatusInternalServerError}
+		}
+		r.URL.Path = "/" + filepath.ToSlash(repoPath) + route.extraPath
 		backend = &cgi.Handler{
-			Path:   GitHTTPBackend,
+			Path:   conf.GitHTTPBackend,
 			Dir:    dir,
-			Env:    []string{"GIT_HTTP_EXPORT_ALL=", "GIT_PROJECT_ROOT=" + filepath.Join(StorageDir, route.vcs.ShortName())},
+			Env:    []string{"GIT_HTTP_EXPORT_ALL=", "GIT_PROJECT_ROOT=" + projectRoot},
 			Logger: logger,
 		}
+		if p := gitProtocol(r); p != "" {
+			backend.Env = append(backend.Env, "GIT_PROTOCOL="+p)
+		}
 	case vcs.Hg:
-		rootPath, err := filepath.Rel(StorageDir, dir)
+		if conf.HgBinary != "" {
+			span.SetAttribute("backend", "hg serve")
+			r.URL.Path = "/" + strings.TrimPrefix(route.extraPath, "/")
+			injectTraceparent(ctx, r.Header)
+			return hgServers.serveHTTP(rr, r, conf.HgBinary, dir)
+		}
+		span.SetAttribute("backend", "hgweb")
+
+		// Fall back to running hgweb with Python 2.7 for each request.
+		rootPath, err := filepath.Rel(conf.StorageDir, dir)
 		if err != nil {
-			log.Print(err)
+			requestLogger(r).Error("failed to get root path", "err", err)
 			return &httpError{"failed to get root path", http.StatusInternalServerError}
 		}
 		r.URL.Path = route.extraPath
 		backend = &cgi.Handler{
-			Path: Python27,
+			Path: conf.Python27,
 			Root: "/" + rootPath,
 			Dir:  dir,
 			Env:  []string{"HG_REPO_DIR=" + dir},
@@ -43,10 +75,10 @@ func proxy(w http.ResponseWriter, r *http.Request, route *route, dir string) *ht
 		return &httpError{"unknown VCS type", http.StatusBadRequest}
 	}
 
-	rr := newRecorder(w)
 	backend.ServeHTTP(rr, r)
+	span.SetAttribute("status", rr.Code)
 	if rr.Code != http.StatusOK {
-		log.Printf("CGI: HTTP response code %d", rr.Code)
+		requestLogger(r).Warn("CGI response status", "repo", route.uri, "status", rr.Code)
 	}
 
 	return nil
@@ -86,6 +118,13 @@ func (rw *responseRecorder) WriteHeader(code int) {
 	rw.underlying.WriteHeader(code)
 }
 
+// Flush flushes the underlying ResponseWriter, if it is an http.Flusher.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.underlying.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return rw.underlying.(http.Hijacker).Hijack()
 }
@@ -40,7 +40,7 @@ func TestProxy(t *testing.T) {
 			handler: New([]string{"github.com"}),
 			proxies: []proxyTest{{
 				vcs:                   git,
-				uri:                   "github.com/sqs/vcsserver-gittest.git",
+				uri:                   "github.com/sqs/vcsserver-gittest",
 				cloneURL:              "git://github.com/sqs/vcsserver-gittest.git",
 				ensureLocalFileExists: "foo",
 			}},
@@ -73,13 +73,13 @@ func groupTestProxy(t *testing.T, test proxyTestGroup) {
 	defer s.Close()
 
 	for _, proxy := range test.proxies {
-		testProxy(t, proxy, s.URL)
+		testProxy(t, test.handler, proxy, s.URL)
 	}
 }
 
-func testProxy(t *testing.T, test proxyTest, serverURL string) {
-	actionkey := "clone:" + test.cloneURL
-	pre := actions[actionkey]
+func testProxy(t *testing.T, h *Handler, test proxyTest, serverURL string) {
+	cloneURL, _ := url.Parse(test.cloneURL)
+	pre := h.metrics.mirrorOpCount("clone", cloneURL.Host)
 
 	// Make a temp dir for the client to clone the repo into.
 	tmpdir, err := ioutil.TempDir("", "vcsserver-local")
@@ -88,7 +88,6 @@ func testProxy(t *testing.T, test proxyTest, serverURL string) {
 	}
 	defer os.RemoveAll(tmpdir)
 
-	cloneURL, _ := url.Parse(test.cloneURL)
 	clonePath := ClonePath(test.vcs.ShortName(), cloneURL)
 
 	localRepoDir := filepath.Join(tmpdir, "repo")
@@ -131,16 +130,16 @@ func testProxy(t *testing.T, test proxyTest, serverURL string) {
 		t.Errorf("no storedRepoDir contains a cloned repo (did the repo get cloned by the mapping handler?)")
 	}
 
-	testUpdate(t, test, serverURL, localRepoDir)
+	testUpdate(t, h, test, serverURL, localRepoDir)
 
-	if post := actions[actionkey]; post != pre+1 {
-		t.Errorf("want 1 %s to have occurred during proxy, got %d", actionkey, post-pre)
+	if post := h.metrics.mirrorOpCount("clone", cloneURL.Host); post != pre+1 {
+		t.Errorf("want 1 clone of %s to have occurred during proxy, got %v", test.cloneURL, post-pre)
 	}
 }
 
-func testUpdate(t *testing.T, test proxyTest, serverURL string, repodir string) {
-	actionkey := "update:" + test.cloneURL
-	pre := actions[actionkey]
+func testUpdate(t *testing.T, h *Handler, test proxyTest, serverURL string, repodir string) {
+	cloneURL, _ := url.Parse(test.cloneURL)
+	pre := h.metrics.mirrorOpCount("update", cloneURL.Host)
 
 	repo, err := test.vcs.Open(repodir)
 	if err != nil {
@@ -151,7 +150,7 @@ func testUpdate(t *testing.T, test proxyTest, serverURL string, repodir string)
 		t.Fatal("Download failed:", err)
 	}
 
-	if post := actions[actionkey]; post != pre+1 {
-		t.Errorf("want 1 %s to have occurred during proxy, got %d", actionkey, post-pre)
+	if post := h.metrics.mirrorOpCount("update", cloneURL.Host); post != pre+1 {
+		t.Errorf("want 1 update of %s to have occurred during proxy, got %v", test.cloneURL, post-pre)
 	}
 }
@@ -0,0 +1,163 @@
+package vcsserver
+
+import (
+	"bytes"
+	"github.com/sourcegraph/go-vcs"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PushPolicy determines how vcsserver handles pushes to mirrored repositories.
+type PushPolicy string
+
+const (
+	// RejectPushes rejects pushes with HTTP 403 Forbidden.
+	RejectPushes PushPolicy = "reject"
+
+	// ForwardPushes forwards pushes to the upstream repository (which must
+	// have an HTTP or HTTPS clone URL) and then updates the mirror.
+	ForwardPushes PushPolicy = "forward"
+)
+
+// Push is the policy for pushes to mirrored repositories. It is the default for
+// Config.Push.
+var Push = RejectPushes
+
+// isPush returns true if r is part of a push (git-receive-pack or hg
+// unbundle/pushkey, including pushkey commands in an hg batch) to the
+// repository.
+func isPush(vc vcs.VCS, r *http.Request, extraPath string) bool {
+	switch vc {
+	case vcs.Git:
+		return extraPath == "/git-receive-pack" || (extraPath == "/info/refs" && r.URL.Query().Get("service") == "git-receive-pack")
+	case vcs.Hg:
+		switch r.URL.Query().Get("cmd") {
+		case "unbundle", "pushkey":
+			return true
+		case "batch":
+			cmds, ok := hgBatchCommands(r)
+			if !ok {
+				// Treat batches that we can't inspect as pushes.
+				return true
+			}
+			for _, cmd := range cmds {
+				if cmd == "unbundle" || cmd == "pushkey" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// maxHgPostArgs is the maximum size of the arguments that hg sends in the body
+// of a request (with the httppostargs capability) that hgBatchCommands reads.
+const maxHgPostArgs = 1 << 20
+
+// hgBatchCommands returns the names of the commands in r, an hg batch request.
+// The batch's "cmds" argument (e.g., "heads ;pushkey namespace=bookmarks,...")
+// is sent in the query string, in X-HgArg-<n> headers, or at the start of the
+// body (whose length is in the X-HgArgs-Post header), which is restored
+// after reading. It returns false if the arguments can't be read.
+func hgBatchCommands(r *http.Request) ([]string, bool) {
+	args := r.URL.RawQuery + "&"
+	for i := 1; r.Header.Get("X-HgArg-"+strconv.Itoa(i)) != ""; i++ {
+		args += r.Header.Get("X-HgArg-" + strconv.Itoa(i))
+	}
+	if v := r.Header.Get("X-HgArgs-Post"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxHgPostArgs || r.Body == nil {
+			return nil, false
+		}
+		body := make([]byte, n)
+		read, err := io.ReadFull(r.Body, body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body[:read]), r.Body), r.Body}
+		if err != nil {
+			return nil, false
+		}
+		args += "&" + string(body)
+	}
+
+	q, err := url.ParseQuery(args)
+	if err != nil {
+		return nil, false
+	}
+	var cmds []string
+	for _, v := range q["cmds"] {
+		for _, cmd := range strings.Split(v, ";") {
+			cmds = append(cmds, strings.SplitN(cmd, " ", 2)[0])
+		}
+	}
+	return cmds, true
+}
+
+// updatesUpstream returns true if r, a push request, modifies the upstream
+// repository (as opposed to only inspecting it), so that the mirror must be
+// updated afterwards. All hg push requests (see isPush) modify it.
+func updatesUpstream(vc vcs.VCS, r *http.Request, extraPath string) bool {
+	return vc == vcs.Hg || (r.Method == "POST" && extraPath == "/git-receive-pack")
+}
+
+// push handles a push request according to conf.Push. It must be called
+// without holding the repository's mutex, since it may update the mirror.
+func (h *Handler) push(w http.ResponseWriter, r *http.Request, conf *Config, route *route, dir string) *httpError {
+	if conf.Push != ForwardPushes {
+		return &httpError{"pushing to mirrored repositories is not allowed; push to the upstream repository instead", http.StatusForbidden}
+	}
+
+	rr := newRecorder(w)
+	if err := forwardPush(rr, r, route.cloneURL, route.extraPath); err != nil {
+		return err
+	}
+
+	// Update the mirror so it doesn't diverge from the upstream repository.
+	if rr.Code == http.StatusOK && updatesUpstream(route.vcs, r, route.extraPath) {
+		if err := h.cloneOrUpdate(r.Context(), conf, route.vcs, dir, route.cloneURL, true); err != nil {
+			requestLogger(r).Warn("updating mirror after push failed", "cloneURL", route.cloneURL, "err", err.message)
+		}
+	}
+	return nil
+}
+
+// forwardPush forwards the push request r to the upstream repository at
+// cloneURL. The client's credentials (if any) are passed through, unless they
+// were issued by vcsserver (see Identity).
+func forwardPush(w http.ResponseWriter, r *http.Request, cloneURL, extraPath string) *httpError {
+	upstream, err := url.Parse(cloneURL)
+	if err != nil {
+		requestLogger(r).Error("bad clone URL", "err", err)
+		return &httpError{"bad clone URL", http.StatusInternalServerError}
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" {
+		return &httpError{"pushes can only be forwarded to HTTP or HTTPS upstream repositories", http.StatusForbidden}
+	}
+
+	ctx, span := startSpan(r.Context(), "forwardPush")
+	span.SetAttribute("upstream", upstream.Host)
+	defer span.Finish()
+	// Credentials issued by vcsserver (unlike upstream credentials validated
+	// by an auth webhook) mean nothing upstream, so don't forward them.
+	ident := requestIdentity(r)
+	issued := ident != nil && ident.issued
+	backend := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = upstream.Scheme
+			req.URL.Host = upstream.Host
+			req.URL.Path = upstream.Path + extraPath
+			req.Host = upstream.Host
+			if issued {
+				req.Header.Del("Authorization")
+			}
+			injectTraceparent(ctx, req.Header)
+		},
+	}
+	backend.ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,118 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestIsPush(t *testing.T) {
+	tests := []struct {
+		vcs       vcs.VCS
+		method    string
+		url       string
+		extraPath string
+		header    http.Header
+		body      string
+		want      bool
+	}{
+		{vcs.Git, "GET", "/info/refs?service=git-receive-pack", "/info/refs", nil, "", true},
+		{vcs.Git, "POST", "/git-receive-pack", "/git-receive-pack", nil, "", true},
+		{vcs.Git, "GET", "/info/refs?service=git-upload-pack", "/info/refs", nil, "", false},
+		{vcs.Git, "POST", "/git-upload-pack", "/git-upload-pack", nil, "", false},
+		{vcs.Hg, "POST", "/?cmd=unbundle", "", nil, "", true},
+		{vcs.Hg, "POST", "/?cmd=pushkey", "", nil, "", true},
+		{vcs.Hg, "GET", "/?cmd=capabilities", "", nil, "", false},
+		{vcs.Hg, "GET", "/?cmd=batch&cmds=heads+%3Bknown+nodes%3D", "", nil, "", false},
+		{vcs.Hg, "GET", "/?cmd=batch&cmds=heads+%3Bpushkey+namespace%3Dbookmarks", "", nil, "", true},
+		{vcs.Hg, "GET", "/?cmd=batch", "", http.Header{"X-Hgarg-1": {"cmds=heads+%3Bknown+nodes%3D"}}, "", false},
+		{vcs.Hg, "GET", "/?cmd=batch", "", http.Header{"X-Hgarg-1": {"cmds=heads+%3Bpus"}, "X-Hgarg-2": {"hkey+namespace%3Dphases"}}, "", true},
+		{vcs.Hg, "POST", "/?cmd=batch", "", http.Header{"X-Hgargs-Post": {"31"}}, "cmds=pushkey+namespace%3Dphases", true},
+		{vcs.Hg, "POST", "/?cmd=batch", "", http.Header{"X-Hgargs-Post": {"11"}}, "cmds=heads+", false},
+		{vcs.Hg, "POST", "/?cmd=batch", "", http.Header{"X-Hgargs-Post": {"100"}}, "cmds=heads+", true},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			r.Header[k] = v
+		}
+		if got := isPush(test.vcs, r, test.extraPath); got != test.want {
+			t.Errorf("%s %s %s %v: want isPush %v, got %v", test.vcs.ShortName(), test.method, test.url, test.header, test.want, got)
+		}
+		if body, _ := ioutil.ReadAll(r.Body); string(body) != test.body {
+			t.Errorf("%s %s %s %v: want body %q after isPush, got %q", test.vcs.ShortName(), test.method, test.url, test.header, test.body, body)
+		}
+	}
+}
+
+func TestPushRejected(t *testing.T) {
+	s := httptest.NewServer(New([]string{"example.com"}))
+	defer s.Close()
+
+	for _, url := range []string{
+		"/git/https/example.com/foo.git/info/refs?service=git-receive-pack",
+		"/hg/https/example.com/foo/-?cmd=unbundle",
+	} {
+		data, statusCode := httpGET(t, s.URL+url)
+		if statusCode != http.StatusForbidden {
+			t.Errorf("%s: want statusCode == %d, got %d (%q)", url, http.StatusForbidden, statusCode, data)
+		}
+	}
+}
+
+func TestForwardPush(t *testing.T) {
+	var gotPath, gotQuery, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery, gotAuth = r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	r, err := http.NewRequest("GET", "/git/http/example.com/foo.git/info/refs?service=git-receive-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	if err := forwardPush(w, r, upstream.URL+"/foo.git", "/info/refs"); err != nil {
+		t.Fatalf("forwardPush: %s", err.message)
+	}
+
+	if w.Code != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, w.Code)
+	}
+	if want := "/foo.git/info/refs"; gotPath != want {
+		t.Errorf("want upstream path %q, got %q", want, gotPath)
+	}
+	if want := "service=git-receive-pack"; gotQuery != want {
+		t.Errorf("want upstream query %q, got %q", want, gotQuery)
+	}
+	if gotAuth == "" {
+		t.Error("want credentials to be passed to upstream")
+	}
+
+	// Upstream credentials validated by an auth webhook are forwarded, but
+	// credentials issued by vcsserver are not.
+	for _, issued := range []bool{false, true} {
+		gotAuth = ""
+		ident := &Identity{User: "alice", Scopes: []Scope{ScopeClone}, issued: issued}
+		if err := forwardPush(httptest.NewRecorder(), withIdentity(r, ident), upstream.URL+"/foo.git", "/info/refs"); err != nil {
+			t.Fatalf("forwardPush: %s", err.message)
+		}
+		if forwarded := gotAuth != ""; forwarded == issued {
+			t.Errorf("issued=%v: want credentials forwarded %v, got %v", issued, !issued, forwarded)
+		}
+	}
+
+	if err := forwardPush(httptest.NewRecorder(), r, "git://example.com/foo.git", "/info/refs"); err == nil || err.statusCode != http.StatusForbidden {
+		t.Errorf("want forwarding to git:// upstream to be forbidden, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package vcsserver
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is the rate and burst size of a token-bucket rate limit.
+type RateLimit struct {
+	// Rate is the number of operations allowed per second, on average. If
+	// zero, operations are not limited.
+	Rate float64
+
+	// Burst is the number of operations that may be performed at once
+	// (after a period of inactivity). If less than 1, it is 1.
+	Burst int
+}
+
+// ClientRateLimit is the default for Config.ClientRateLimit.
+var ClientRateLimit RateLimit
+
+// UpstreamRateLimit is the default for Config.UpstreamRateLimit.
+var UpstreamRateLimit RateLimit
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// rateLimiter enforces a RateLimit separately for each key (e.g., client or
+// upstream host). The limit is passed to each call, so that it can change
+// when the Config is replaced.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	lru     *list.List // keys of buckets, most recently used first
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	elem   *list.Element // in rateLimiter.lru
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lru: list.New()}
+}
+
+// maxBuckets is the maximum number of buckets a rateLimiter keeps. When it
+// is reached, the least recently used bucket is discarded.
+const maxBuckets = 10000
+
+// allow takes a token from key's bucket, if it has one. If not, it returns
+// ok == false and how long to wait until the bucket has a token.
+func (l *rateLimiter) allow(key string, limit RateLimit) (ok bool, retryAfter time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.refill(key, limit, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, durationUntilToken(b, limit)
+}
+
+// wait returns how long to wait until key's bucket has a token, without
+// taking one.
+func (l *rateLimiter) wait(key string, limit RateLimit) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, limit, time.Now())
+	if b.tokens >= 1 {
+		return 0
+	}
+	return durationUntilToken(b, limit)
+}
+
+// refill adds the tokens accrued since key's bucket was last used, creating a
+// full bucket if there is none. It must be called with l.mu held.
+func (l *rateLimiter) refill(key string, limit RateLimit, now time.Time) *tokenBucket {
+	b, present := l.buckets[key]
+	if !present {
+		if l.lru.Len() >= maxBuckets {
+			oldest := l.lru.Back()
+			delete(l.buckets, l.lru.Remove(oldest).(string))
+		}
+		b = &tokenBucket{tokens: limit.burst(), last: now, elem: l.lru.PushFront(key)}
+		l.buckets[key] = b
+		return b
+	}
+	l.lru.MoveToFront(b.elem)
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	return b
+}
+
+func durationUntilToken(b *tokenBucket, limit RateLimit) time.Duration {
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// setRetryAfter sets the Retry-After header to d, in whole seconds (rounded
+// up, and at least 1).
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds())))))
+}
+
+// clientIP returns the IP address of r's client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitClient applies conf.ClientRateLimit to r's client, identified by its
+// IP address. It is called before the request is authenticated, so that
+// requests with invalid credentials are limited too.
+func (h *Handler) limitClient(w http.ResponseWriter, r *http.Request, conf *Config) *httpError {
+	return h.limitClientKey(w, conf, "ip:"+clientIP(r))
+}
+
+// limitUser applies conf.ClientRateLimit to the authenticated user ident, so
+// that a user's requests are limited across all of their IP addresses.
+func (h *Handler) limitUser(w http.ResponseWriter, conf *Config, ident *Identity) *httpError {
+	return h.limitClientKey(w, conf, "user:"+ident.User)
+}
+
+func (h *Handler) limitClientKey(w http.ResponseWriter, conf *Config, key string) *httpError {
+	if ok, retryAfter := h.clientLimiter.allow(key, conf.ClientRateLimit); !ok {
+		setRetryAfter(w, retryAfter)
+		return &httpError{"rate limit exceeded", http.StatusTooManyRequests}
+	}
+	return nil
+}
+
+// upstreamHost returns the host of cloneURL, which is the key for upstream
+// rate limiting.
+func upstreamHost(cloneURL string) string {
+	if u, err := url.Parse(cloneURL); err == nil {
+		return u.Host
+	}
+	return cloneURL
+}
+
+// limitUpstream applies conf.UpstreamRateLimit to a clone or update of the
+// repository at cloneURL.
+func (h *Handler) limitUpstream(conf *Config, cloneURL string) *httpError {
+	if ok, _ := h.upstreamLimiter.allow(upstreamHost(cloneURL), conf.UpstreamRateLimit); !ok {
+		return &httpError{"upstream rate limit exceeded for " + upstreamHost(cloneURL), http.StatusTooManyRequests}
+	}
+	return nil
+}
+
+// upstreamRetryAfter returns err, the error of a clone or update of the
+// repository at cloneURL, after telling the client when to retry if the
+// upstream rate limit was exceeded.
+func (h *Handler) upstreamRetryAfter(w http.ResponseWriter, conf *Config, cloneURL string, err *httpError) *httpError {
+	if err.statusCode == http.StatusTooManyRequests {
+		setRetryAfter(w, h.upstreamLimiter.wait(upstreamHost(cloneURL), conf.UpstreamRateLimit))
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package vcsserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	limit := RateLimit{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", limit); !ok {
+			t.Fatalf("request %d within burst was not allowed", i)
+		}
+	}
+	ok, retryAfter := l.allow("a", limit)
+	if ok {
+		t.Fatal("request beyond burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 500*time.Millisecond {
+		t.Errorf("got retryAfter %s, want (0, 500ms]", retryAfter)
+	}
+	if wait := l.wait("a", limit); wait <= 0 {
+		t.Errorf("got wait %s, want > 0", wait)
+	}
+
+	// Other keys have their own buckets.
+	if ok, _ := l.allow("b", limit); !ok {
+		t.Error("request for other key was not allowed")
+	}
+
+	// Tokens accrue at Rate per second.
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", limit); !ok {
+			t.Errorf("request %d after refill was not allowed", i)
+		}
+	}
+	if ok, _ := l.allow("a", limit); ok {
+		t.Error("request beyond refill was allowed")
+	}
+
+	// The least recently used buckets are discarded beyond maxBuckets.
+	for i := 0; i < maxBuckets; i++ {
+		l.allow("k"+strconv.Itoa(i), limit)
+	}
+	if len(l.buckets) != maxBuckets || l.lru.Len() != maxBuckets {
+		t.Errorf("got %d buckets (%d in LRU list), want %d", len(l.buckets), l.lru.Len(), maxBuckets)
+	}
+	if _, present := l.buckets["a"]; present {
+		t.Error("least recently used bucket was not discarded")
+	}
+
+	// A zero rate is unlimited.
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("c", RateLimit{}); !ok {
+			t.Fatal("request with no limit was not allowed")
+		}
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	h := New(nil)
+	defer h.Close()
+	h.SetConfig(&Config{
+		AccessPolicy:      *HostsPolicy([]string{"example.invalid"}),
+		StorageDir:        tmpdir,
+		GitBinary:         GitBinary,
+		ClientRateLimit:   RateLimit{Rate: 0.001, Burst: 3},
+		UpstreamRateLimit: RateLimit{Rate: 0.001, Burst: 1},
+	})
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/git/https/example.invalid/repo.git/info/refs?service=git-upload-pack", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The first request's clone fails (since the host doesn't exist), and
+	// the second request may not clone again.
+	if rr := get("192.0.2.1:1234"); rr.Code == http.StatusTooManyRequests {
+		t.Fatalf("first request: got %d", rr.Code)
+	}
+	rr := get("192.0.2.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: got %d, want 429 (upstream limit)", rr.Code)
+	}
+	if n, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || n < 1 {
+		t.Errorf("got Retry-After %q, want a positive number of seconds", rr.Header().Get("Retry-After"))
+	}
+
+	get("192.0.2.1:1234")
+	rr = get("192.0.2.1:1234")
+	if rr.Code != http.StatusTooManyRequests || rr.Body.String() != "rate limit exceeded\n" {
+		t.Fatalf("fourth request: got %d %q, want 429 (client limit)", rr.Code, rr.Body)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("got no Retry-After header")
+	}
+
+	// Other clients aren't limited by the first client's requests.
+	if rr := get("192.0.2.2:1234"); rr.Body.String() == "rate limit exceeded\n" {
+		t.Errorf("other client: got client rate limit error")
+	}
+}
+
+func TestHandler_RateLimitUser(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	h := New(nil)
+	defer h.Close()
+	h.Authenticator = &StaticAuthenticator{Tokens: map[string]*Identity{
+		"tok": {User: "alice", Scopes: []Scope{ScopeBlame}},
+	}}
+	h.SetConfig(&Config{
+		AccessPolicy:    *HostsPolicy([]string{"example.com"}),
+		StorageDir:      tmpdir,
+		Offline:         true,
+		GitBinary:       GitBinary,
+		ClientRateLimit: RateLimit{Rate: 0.001, Burst: 2},
+	})
+
+	get := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	limited := func(rr *httptest.ResponseRecorder) bool {
+		return rr.Code == http.StatusTooManyRequests && rr.Body.String() == "rate limit exceeded\n"
+	}
+
+	// Invalid tokens are limited by IP address before they are checked.
+	for i, want := range []bool{false, false, true} {
+		if got := limited(get("192.0.2.1:1234", "junk"+strconv.Itoa(i))); got != want {
+			t.Errorf("invalid token %d: got limited %v, want %v", i, got, want)
+		}
+	}
+
+	// A user is limited across IP addresses.
+	for i, want := range []bool{false, false, true} {
+		if got := limited(get("192.0.2."+strconv.Itoa(10+i)+":1234", "tok")); got != want {
+			t.Errorf("user request %d: got limited %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestHandler_UpstreamRateLimitExistingMirror(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	hostDir := filepath.Join(tmpdir, "git", "example.invalid")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(makeGitRepo(t, hostDir), filepath.Join(hostDir, "repo")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(nil)
+	defer h.Close()
+	h.SetConfig(&Config{
+		AccessPolicy:      *HostsPolicy([]string{"example.invalid"}),
+		StorageDir:        tmpdir,
+		GitBinary:         GitBinary,
+		UpstreamRateLimit: RateLimit{Rate: 0.001, Burst: 1},
+	})
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/git/https/example.invalid/repo.git/api/blame/master/foo", nil)
+		req.Header.Set(forceUpdateHeader, "1")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The first request's update fails (since the host doesn't exist), and
+	// the second request is served from the existing mirror without an
+	// update.
+	get()
+	if rr := get(); rr.Code != http.StatusOK {
+		t.Errorf("second request: got %d, want 200: %s", rr.Code, rr.Body)
+	}
+	if n := h.metrics.mirrorOpCount("update", "example.invalid"); n != 1 {
+		t.Errorf("got %v updates, want 1", n)
+	}
+}
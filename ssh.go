@@ -0,0 +1,131 @@
+package vcsserver
+
+import (
+	"fmt"
+	"github.com/sourcegraph/go-vcs"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SSHConfig describes how to clone repositories from a host over SSH.
+type SSHConfig struct {
+	// User is the SSH user name. If empty, "git" is used.
+	User string
+
+	// Key is the path to the SSH private key file. If empty, ssh's default
+	// keys are used.
+	Key string
+
+	// KnownHosts is the path to the known_hosts file that is used to verify
+	// the host's key. If empty, ssh's default known_hosts files are used.
+	KnownHosts string
+
+	// SCPStyle is whether to clone git repositories using scp-style URLs
+	// (user@host:path) instead of ssh:// URLs. It is ignored for hg
+	// repositories and for hosts with a port.
+	SCPStyle bool
+}
+
+// sshConfig returns the SSHConfig of the host rule that matches cloneURL's host,
+// or nil if cloneURL is not an ssh:// URL.
+func (c *Config) sshConfig(cloneURL *url.URL) *SSHConfig {
+	if cloneURL.Scheme != "ssh" {
+		return nil
+	}
+	if rule := c.rule(cloneURL.Host); rule != nil && rule.SSH != nil {
+		return rule.SSH
+	}
+	return &SSHConfig{}
+}
+
+// upstreamURL returns the URL that is used to clone the repository identified
+// by cloneURL (an ssh:// URL without a user name).
+func (c *SSHConfig) upstreamURL(vc vcs.VCS, cloneURL *url.URL) string {
+	user := c.User
+	if user == "" {
+		user = "git"
+	}
+	if c.SCPStyle && vc == vcs.Git && cloneURL.Port() == "" {
+		return user + "@" + cloneURL.Host + ":" + strings.TrimPrefix(cloneURL.Path, "/")
+	}
+	u := *cloneURL
+	u.User = url.User(user)
+	return u.String()
+}
+
+// command returns the ssh command line that uses c's key and known_hosts file.
+func (c *SSHConfig) command() string {
+	args := []string{"ssh", "-o", "BatchMode=yes"}
+	if c.Key != "" {
+		args = append(args, "-i", shellQuote(c.Key), "-o", "IdentitiesOnly=yes")
+	}
+	if c.KnownHosts != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+c.KnownHosts), "-o", "StrictHostKeyChecking=yes")
+	}
+	return strings.Join(args, " ")
+}
+
+// sshCloneMirror clones a mirror of the repository at cloneURL (an ssh:// URL)
+// into dir, and configures the mirror to use the host's SSH settings for
+// subsequent updates.
+func (c *Config) sshCloneMirror(vc vcs.VCS, cloneURL *url.URL, dir string) error {
+	ssh := c.sshConfig(cloneURL)
+	upstream := ssh.upstreamURL(vc, cloneURL)
+	switch vc {
+	case vcs.Git:
+		return run(exec.Command(c.GitBinary, "clone", "--mirror", "--config", "core.sshCommand="+ssh.command(), upstream, dir))
+	case vcs.Hg:
+		if err := run(exec.Command(c.hgBinary(), "clone", "-U", "--ssh", ssh.command(), upstream, dir)); err != nil {
+			return err
+		}
+		return c.sshConfigureMirror(vc, cloneURL, dir)
+	}
+	return fmt.Errorf("SSH clone URLs are not supported for %s", vc.ShortName())
+}
+
+// sshConfigureMirror configures the mirror at dir of the repository at cloneURL
+// (an ssh:// URL) to fetch using the host's current SSH settings.
+func (c *Config) sshConfigureMirror(vc vcs.VCS, cloneURL *url.URL, dir string) error {
+	ssh := c.sshConfig(cloneURL)
+	upstream := ssh.upstreamURL(vc, cloneURL)
+	switch vc {
+	case vcs.Git:
+		cmd := exec.Command(c.GitBinary, "config", "core.sshCommand", ssh.command())
+		cmd.Dir = dir
+		if err := run(cmd); err != nil {
+			return err
+		}
+		cmd = exec.Command(c.GitBinary, "remote", "set-url", "origin", upstream)
+		cmd.Dir = dir
+		return run(cmd)
+	case vcs.Hg:
+		hgrc := fmt.Sprintf("[paths]\ndefault = %s\n\n[ui]\nssh = %s\n", upstream, ssh.command())
+		return ioutil.WriteFile(filepath.Join(dir, ".hg", "hgrc"), []byte(hgrc), 0600)
+	}
+	return fmt.Errorf("SSH clone URLs are not supported for %s", vc.ShortName())
+}
+
+// hgBinary returns c.HgBinary, or "hg" if it is empty.
+func (c *Config) hgBinary() string {
+	if c.HgBinary == "" {
+		return "hg"
+	}
+	return c.HgBinary
+}
+
+// run runs cmd and returns an error that includes its output if it fails.
+func run(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s (output: %q)", strings.Join(cmd.Args, " "), err, out)
+	}
+	return nil
+}
+
+// shellQuote quotes s for use as a single word in a shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,75 @@
+package vcsserver
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/sourcegraph/go-vcs"
+)
+
+func TestSSHConfig_UpstreamURL(t *testing.T) {
+	tests := []struct {
+		ssh      *SSHConfig
+		vcs      vcs.VCS
+		cloneURL string
+		want     string
+	}{
+		{&SSHConfig{}, vcs.Git, "ssh://git.example.com/group/repo.git", "ssh://git@git.example.com/group/repo.git"},
+		{&SSHConfig{User: "alice"}, vcs.Hg, "ssh://hg.example.com/repo", "ssh://alice@hg.example.com/repo"},
+		{&SSHConfig{SCPStyle: true}, vcs.Git, "ssh://git.example.com/group/repo.git", "git@git.example.com:group/repo.git"},
+		{&SSHConfig{SCPStyle: true}, vcs.Hg, "ssh://hg.example.com/repo", "ssh://git@hg.example.com/repo"},
+	}
+
+	for _, test := range tests {
+		cloneURL, err := url.Parse(test.cloneURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := test.ssh.upstreamURL(test.vcs, cloneURL); got != test.want {
+			t.Errorf("%s %+v: want upstream URL %q, got %q", test.cloneURL, test.ssh, test.want, got)
+		}
+	}
+}
+
+func TestSSHConfig_Command(t *testing.T) {
+	tests := []struct {
+		ssh  *SSHConfig
+		want string
+	}{
+		{&SSHConfig{}, "ssh -o BatchMode=yes"},
+		{
+			&SSHConfig{Key: "/etc/vcsserver/id_rsa", KnownHosts: "/etc/vcsserver/known hosts"},
+			"ssh -o BatchMode=yes -i '/etc/vcsserver/id_rsa' -o IdentitiesOnly=yes -o 'UserKnownHostsFile=/etc/vcsserver/known hosts' -o StrictHostKeyChecking=yes",
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.ssh.command(); got != test.want {
+			t.Errorf("%+v: want command %q, got %q", test.ssh, test.want, got)
+		}
+	}
+}
+
+func TestConfig_SSHConfig(t *testing.T) {
+	ssh := &SSHConfig{Key: "/etc/vcsserver/id_rsa"}
+	conf := &Config{AccessPolicy: AccessPolicy{Hosts: []*HostRule{{Host: "*.internal", SSH: ssh}, {Host: "example.com"}}}}
+
+	tests := []struct {
+		cloneURL string
+		want     *SSHConfig
+	}{
+		{"ssh://git.internal/repo.git", ssh},
+		{"https://git.internal/repo.git", nil},
+		{"ssh://example.com/repo.git", &SSHConfig{}},
+	}
+	for _, test := range tests {
+		cloneURL, err := url.Parse(test.cloneURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := conf.sshConfig(cloneURL)
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("%s: want SSH config %+v, got %+v", test.cloneURL, test.want, got)
+		}
+	}
+}
@@ -8,14 +8,16 @@ import (
 )
 
 // StorageDir is the root directory underneath which repositories are stored.
+// It is the default for Config.StorageDir.
 var StorageDir = "/tmp/vcsserver"
 
-func repoDir(vcs vcs.VCS, uri string) string {
-	preferred := filepath.Join(StorageDir, vcs.ShortName(), uri)
+func (c *Config) repoDir(vcs vcs.VCS, uri string) string {
+	preferred := filepath.Join(c.StorageDir, vcs.ShortName(), uriToPath(uri))
 
-	// if we're running offline, try harder to find a local copy
-	if Offline {
-		if alternate := strings.TrimSuffix(preferred, ".git"); isDir(alternate) {
+	// if we're running offline, try harder to find a local copy (mirrors
+	// stored before clone URLs were canonicalized kept their ".git" suffix)
+	if c.Offline && !isDir(preferred) {
+		if alternate := preferred + ".git"; isDir(alternate) {
 			return alternate
 		}
 	}
@@ -23,6 +25,18 @@ func repoDir(vcs vcs.VCS, uri string) string {
 	return preferred
 }
 
+// uriToPath returns the path of the mirror of the repository identified by uri
+// (e.g., "example.com:8443/foo"), relative to the storage directory for its
+// VCS. Colons in the host, which separate ports and appear in IPv6 addresses,
+// are replaced with underscores (which can't appear in host names).
+func uriToPath(uri string) string {
+	host, rest := uri, ""
+	if i := strings.Index(uri, "/"); i != -1 {
+		host, rest = uri[:i], uri[i:]
+	}
+	return strings.Replace(host, ":", "_", -1) + rest
+}
+
 // IsDir returns true if path is an existing directory, and false otherwise.
 func isDir(path string) bool {
 	fi, err := os.Stat(path)
@@ -0,0 +1,20 @@
+package vcsserver
+
+import "testing"
+
+func TestURIToPath(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"example.com/foo/bar.git", "example.com/foo/bar.git"},
+		{"example.com:8443/foo", "example.com_8443/foo"},
+		{"[::1]:8443/foo", "[__1]_8443/foo"},
+		{"[::1:8443]/foo", "[__1_8443]/foo"},
+	}
+
+	for _, test := range tests {
+		if got := uriToPath(test.uri); got != test.want {
+			t.Errorf("%s: want %q, got %q", test.uri, test.want, got)
+		}
+	}
+}
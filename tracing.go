@@ -0,0 +1,211 @@
+package vcsserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SpanExporter receives spans when they end (e.g., to send them to a
+// tracing backend). ExportSpan must be safe for concurrent use and must not
+// modify the span.
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+// Span is a timed operation that is part of a trace. Spans are created for the
+// phases of a request (e.g., waiting for an update, the update itself,
+// waiting for the repository lock and running the backend).
+//
+// All methods of a nil *Span are no-ops, so code that creates spans needn't
+// check whether tracing is enabled.
+type Span struct {
+	Name         string
+	TraceID      string // 32 hex digits
+	SpanID       string // 16 hex digits
+	ParentSpanID string `json:",omitempty"`
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{} `json:",omitempty"`
+	Error        string                 `json:",omitempty"`
+
+	mu       sync.Mutex
+	sampled  bool
+	exporter SpanExporter
+	ended    bool
+}
+
+// SetAttribute sets the span's attribute key to value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// SetError records that the span's operation failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = msg
+}
+
+// Finish ends the span and, if it is sampled, exports it. Only the first call
+// has any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+// traceparent returns the W3C Trace Context traceparent header value that
+// identifies s (as the parent of downstream spans).
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-" + flags
+}
+
+// traceparentHeader is the W3C Trace Context header that identifies the
+// caller's span.
+const traceparentHeader = "traceparent"
+
+// parseTraceparent parses a W3C Trace Context traceparent header value. It
+// returns ok == false if it is not valid.
+func parseTraceparent(v string) (traceID, spanID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	for _, p := range parts[:4] {
+		if !isHex(p) {
+			return "", "", false, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return parts[1], parts[2], flags[0]&1 == 1, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type spanKey struct{}
+
+// startRequestSpan starts the root span of a request, which continues the
+// trace in r's traceparent header, if any. If exporter is nil, tracing is
+// disabled and it returns r and a nil span.
+func startRequestSpan(r *http.Request, exporter SpanExporter, name string) (*http.Request, *Span) {
+	if exporter == nil {
+		return r, nil
+	}
+	s := &Span{Name: name, SpanID: randomHex(8), Start: time.Now(), sampled: true, exporter: exporter}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		s.TraceID, s.ParentSpanID, s.sampled = traceID, parentID, sampled
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, s)), s
+}
+
+// startSpan starts a child of the span in ctx, if any, and returns a context
+// containing the child. If ctx contains no span, it returns ctx and a nil
+// span.
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		Name:         name,
+		TraceID:      parent.TraceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parent.SpanID,
+		Start:        time.Now(),
+		sampled:      parent.sampled,
+		exporter:     parent.exporter,
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// injectTraceparent sets the traceparent header of an outgoing request (e.g.,
+// one proxied to an upstream server) to identify the span in ctx, if any.
+func injectTraceparent(ctx context.Context, header http.Header) {
+	if s, _ := ctx.Value(spanKey{}).(*Span); s != nil {
+		header.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+// detachSpan returns a context that is never canceled but carries the span and
+// request-scoped logger in ctx, if any, for work that outlives a request.
+func detachSpan(ctx context.Context) context.Context {
+	detached := context.Background()
+	if s, _ := ctx.Value(spanKey{}).(*Span); s != nil {
+		detached = context.WithValue(detached, spanKey{}, s)
+	}
+	if l, _ := ctx.Value(loggerKey{}).(*Logger); l != nil {
+		detached = context.WithValue(detached, loggerKey{}, l)
+	}
+	return detached
+}
+
+// StdoutExporter is a SpanExporter that writes each span as a JSON object on
+// its own line, which is useful for local testing.
+type StdoutExporter struct {
+	// W is where spans are written. If nil, they are written to stdout.
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (e *StdoutExporter) ExportSpan(s *Span) {
+	s.mu.Lock()
+	b, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w := e.W
+	if w == nil {
+		w = os.Stdout
+	}
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,110 @@
+package vcsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		v               string
+		traceID, spanID string
+		sampled, ok     bool
+	}{
+		{v: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: true, ok: true},
+		{v: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", ok: true},
+		{v: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: true, ok: true},
+		{v: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{v: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{v: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{v: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{v: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{v: "garbage"},
+	}
+	for _, test := range tests {
+		traceID, spanID, sampled, ok := parseTraceparent(test.v)
+		if traceID != test.traceID || spanID != test.spanID || sampled != test.sampled || ok != test.ok {
+			t.Errorf("%q: want (%q, %q, %v, %v), got (%q, %q, %v, %v)", test.v, test.traceID, test.spanID, test.sampled, test.ok, traceID, spanID, sampled, ok)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vcsserver-tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	hostDir := filepath.Join(tmpdir, "git", "example.com")
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	makeGitRepo(t, hostDir)
+
+	var buf bytes.Buffer
+	h := New(nil)
+	defer h.Close()
+	h.Log = NewLogger(ioutil.Discard, LevelError, false)
+	h.SpanExporter = &StdoutExporter{W: &buf}
+	h.SetConfig(&Config{
+		AccessPolicy: *HostsPolicy([]string{"example.com"}),
+		StorageDir:   tmpdir,
+		Offline:      true,
+		GitBinary:    GitBinary,
+	})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	r := httptest.NewRequest("GET", "/git/https/example.com/repo.git/api/blame/master/foo", nil)
+	r.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := make(map[string]*Span)
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var span Span
+		if err := json.Unmarshal(s.Bytes(), &span); err != nil {
+			t.Fatalf("Unmarshal %q: %s", s.Text(), err)
+		}
+		spans[span.Name] = &span
+	}
+
+	root := spans["ServeHTTP"]
+	if root == nil || root.TraceID != traceID || root.ParentSpanID != parentID {
+		t.Fatalf("want root span continuing trace %s from %s, got %+v", traceID, parentID, root)
+	}
+	if root.Attributes["action"] != string(fileBlameAction) || root.Attributes["status"] != float64(200) {
+		t.Errorf("want root span attributes to include action and status, got %v", root.Attributes)
+	}
+	for _, name := range []string{"lock.repo", "blameFile"} {
+		span := spans[name]
+		if span == nil {
+			t.Errorf("want %s span, got none (spans: %v)", name, spans)
+			continue
+		}
+		if span.TraceID != traceID || span.ParentSpanID != root.SpanID || span.End.Before(span.Start) {
+			t.Errorf("want %s span to be a child of the root span, got %+v", name, span)
+		}
+	}
+
+	// Unsampled traces aren't exported.
+	buf.Reset()
+	r.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-00")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if buf.Len() != 0 {
+		t.Errorf("want no spans exported for unsampled trace, got %s", buf.Bytes())
+	}
+}
+
+func TestSpan_Nil(t *testing.T) {
+	var s *Span
+	s.SetAttribute("a", 1)
+	s.SetError("oops")
+	s.Finish()
+}
@@ -9,9 +9,36 @@ import (
 // ClonePath returns the HTTP request path on vcsserver that maps to cloneURL.
 // Applications that use vcsserver to proxy repositories should construct clone
 // URLs with the host URL of vcsserver and the path returned by this function.
+//
+// The returned path has the form /<vcs>/<scheme>/<host>/<path>. If the
+// repository path ends in ".git", that suffix marks the end of the repository
+// path; otherwise the path is followed by a "/-" separator. Repository paths
+// that can't be expressed unambiguously in either form use the legacy form,
+// /<N>/<vcs>/<scheme>/<host>/<path>, where N is the number of path components
+// in <path>.
 func ClonePath(vcs string, cloneURL *url.URL) *url.URL {
-	numPathComponents := strings.Count(cloneURL.Path, "/")
-	return &url.URL{Path: "/" + strconv.Itoa(numPathComponents) + "/" + vcs + "/" + cloneURL.Scheme + "/" + cloneURL.Host + cloneURL.Path}
+	prefix := "/" + vcs + "/" + cloneURL.Scheme + "/" + cloneURL.Host + cloneURL.Path
+	components := strings.Split(strings.TrimPrefix(cloneURL.Path, "/"), "/")
+	for i, c := range components {
+		// The router ends the repository path at the first "-" component
+		// or ".git" suffix, so either one (other than a final ".git"
+		// suffix) requires the legacy form.
+		last := i == len(components)-1
+		if c == repoPathSeparator || (!last && strings.HasSuffix(c, ".git") && c != ".git") {
+			numPathComponents := strings.Count(cloneURL.Path, "/")
+			return pathURL("/" + strconv.Itoa(numPathComponents) + prefix)
+		}
+	}
+	if c := components[len(components)-1]; strings.HasSuffix(c, ".git") && c != ".git" {
+		return pathURL(prefix)
+	}
+	return pathURL(prefix + "/" + repoPathSeparator)
+}
+
+// pathURL returns a URL with path p. Brackets in p (which appear in IPv6
+// hosts) are not escaped.
+func pathURL(p string) *url.URL {
+	return &url.URL{Path: p, RawPath: p}
 }
 
 // FilePath returns the HTTP request path on vcsserver that maps to the
@@ -19,7 +46,7 @@ func ClonePath(vcs string, cloneURL *url.URL) *url.URL {
 // repositories should construct file URLs with the host URL of vcsserver and
 // the path returned by this function.
 func FilePath(vcs string, cloneURL *url.URL, revision, file string) *url.URL {
-	return &url.URL{Path: ClonePath(vcs, cloneURL).Path + "/v/" + revision + "/" + file}
+	return pathURL(ClonePath(vcs, cloneURL).Path + "/v/" + revision + "/" + file)
 }
 
 // BatchFilesURI returns the HTTP request URI on vcsserver that maps to a batch
@@ -30,5 +57,7 @@ func BatchFilesURI(vcs string, cloneURL *url.URL, revision string, files []strin
 	q := make(url.Values)
 	q.Set("return", returnFirstExist)
 	q["file"] = files
-	return &url.URL{Path: ClonePath(vcs, cloneURL).Path + "/v-batch/" + revision, RawQuery: q.Encode()}
+	u := pathURL(ClonePath(vcs, cloneURL).Path + "/v-batch/" + revision)
+	u.RawQuery = q.Encode()
+	return u
 }
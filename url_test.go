@@ -11,8 +11,13 @@ func TestClonePath(t *testing.T) {
 		cloneURL      string
 		wantClonePath string
 	}{
-		{"git", "git://example.com/foo.git", "/1/git/git/example.com/foo.git"},
-		{"git", "https://example.com/foo/bar.git", "/2/git/https/example.com/foo/bar.git"},
+		{"git", "git://example.com/foo.git", "/git/git/example.com/foo.git"},
+		{"git", "https://example.com/foo/bar.git", "/git/https/example.com/foo/bar.git"},
+		{"hg", "https://example.com/foo/bar", "/hg/https/example.com/foo/bar/-"},
+		{"git", "https://example.com/foo.git/bar", "/2/git/https/example.com/foo.git/bar"},
+		{"git", "https://example.com/foo/-/bar.git", "/3/git/https/example.com/foo/-/bar.git"},
+		{"git", "https://git.internal:8443/foo/bar.git", "/git/https/git.internal:8443/foo/bar.git"},
+		{"hg", "http://[::1]:8080/foo", "/hg/http/[::1]:8080/foo/-"},
 	}
 
 	for _, test := range tests {
@@ -36,8 +41,10 @@ func TestFilePath(t *testing.T) {
 		file         string
 		wantFilePath string
 	}{
-		{"git", "git://example.com/foo.git", "master", "foo.txt", "/1/git/git/example.com/foo.git/v/master/foo.txt"},
-		{"git", "https://example.com/foo/bar.git", "1234abcdef", "my/file.txt", "/2/git/https/example.com/foo/bar.git/v/1234abcdef/my/file.txt"},
+		{"git", "git://example.com/foo.git", "master", "foo.txt", "/git/git/example.com/foo.git/v/master/foo.txt"},
+		{"git", "https://example.com/foo/bar.git", "1234abcdef", "my/file.txt", "/git/https/example.com/foo/bar.git/v/1234abcdef/my/file.txt"},
+		{"hg", "https://example.com/foo/bar", "default", "my/file.txt", "/hg/https/example.com/foo/bar/-/v/default/my/file.txt"},
+		{"git", "https://[::1]:8443/foo.git", "master", "my file.txt", "/git/https/%5B::1%5D:8443/foo.git/v/master/my%20file.txt"},
 	}
 
 	for _, test := range tests {
@@ -52,3 +59,91 @@ func TestFilePath(t *testing.T) {
 		}
 	}
 }
+
+func TestClonePath_RoundTrip(t *testing.T) {
+	tests := []struct {
+		vcs      string
+		cloneURL string
+	}{
+		{"git", "git://example.com/foo.git"},
+		{"git", "https://example.com/foo/bar.git"},
+		{"hg", "https://example.com/foo/bar"},
+		{"git", "https://example.com/foo.git/bar"},
+		{"git", "https://example.com/foo/-/bar.git"},
+		{"git", "https://git.internal:8443/foo/bar.git"},
+		{"git", "ssh://git.internal:2222/foo/bar.git"},
+		{"hg", "http://[::1]:8080/foo"},
+		{"hg", "http://[2001:db8::1]/foo"},
+	}
+
+	hosts := []string{"example.com", "git.internal:8443", "git.internal:2222", "[::1]:8080", "[2001:db8::1]"}
+	for _, test := range tests {
+		cloneURL, err := url.Parse(test.cloneURL)
+		if err != nil {
+			t.Errorf("%s: url.Parse failed: %s", test.cloneURL, err)
+			continue
+		}
+		filePath := FilePath(test.vcs, cloneURL, "master", "my/file.txt")
+		route, herr := router(HostsPolicy(hosts), filePath.Path)
+		if herr != nil {
+			t.Errorf("%s: router(%s) failed: %s", test.cloneURL, filePath, herr.message)
+			continue
+		}
+		if route.cloneURL != test.cloneURL {
+			t.Errorf("%s: want routed cloneURL %s, got %s", test.cloneURL, test.cloneURL, route.cloneURL)
+		}
+		if want := "/v/master/my/file.txt"; route.extraPath != want {
+			t.Errorf("%s: want routed extraPath %s, got %s", test.cloneURL, want, route.extraPath)
+		}
+	}
+}
+
+func TestFilePath_RoundTrip(t *testing.T) {
+	tests := []struct {
+		vcs      string
+		cloneURL string
+		revision string
+		file     string
+	}{
+		{"git", "https://example.com/foo/bar.git", "master", "a/-/b.txt"},
+		{"git", "https://example.com/foo/bar.git", "-", "a.txt"},
+		{"git", "https://example.com/foo/bar.git", "master", "a.git/b.txt"},
+		{"hg", "https://example.com/foo/bar", "-", "a/-/b.txt"},
+		{"git", "https://example.com/foo.git/bar", "master", "a/-/b.txt"},
+		{"git", "https://example.com/foo/-/bar.git", "-", "a/-/b.txt"},
+	}
+
+	for _, test := range tests {
+		cloneURL, err := url.Parse(test.cloneURL)
+		if err != nil {
+			t.Errorf("%s: url.Parse failed: %s", test.cloneURL, err)
+			continue
+		}
+
+		filePath := FilePath(test.vcs, cloneURL, test.revision, test.file)
+		route, herr := router(HostsPolicy([]string{"example.com"}), filePath.Path)
+		if herr != nil {
+			t.Errorf("%s: router(%s) failed: %s", test.cloneURL, filePath, herr.message)
+			continue
+		}
+		if route.cloneURL != test.cloneURL || route.action != singleFileAction {
+			t.Errorf("%s: %s routed to %s %s", test.cloneURL, filePath, route.action, route.cloneURL)
+		}
+		if want := "/v/" + test.revision + "/" + test.file; route.extraPath != want {
+			t.Errorf("%s: want routed extraPath %s, got %s", test.cloneURL, want, route.extraPath)
+		}
+
+		batchURI := BatchFilesURI(test.vcs, cloneURL, test.revision, []string{test.file})
+		route, herr = router(HostsPolicy([]string{"example.com"}), batchURI.Path)
+		if herr != nil {
+			t.Errorf("%s: router(%s) failed: %s", test.cloneURL, batchURI, herr.message)
+			continue
+		}
+		if route.cloneURL != test.cloneURL || route.action != batchFileAction {
+			t.Errorf("%s: %s routed to %s %s", test.cloneURL, batchURI, route.action, route.cloneURL)
+		}
+		if want := "/v-batch/" + test.revision; route.extraPath != want {
+			t.Errorf("%s: want routed extraPath %s, got %s", test.cloneURL, want, route.extraPath)
+		}
+	}
+}